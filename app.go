@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+//App owns config, logger, storage, meme sources and bot. It is built by main.
+//Sources and bot are copies of config sections, settings changed by reload are read from Config.
+type App struct {
+	//ConfigPath is file config is reloaded from
+	ConfigPath string
+	Log        *log.Logger
+	Storage    *Storage
+	VK         *VK
+	Reddit     *Reddit
+	Telegram   *Telegram
+	Bot        *TelegramBot
+
+	//logSink sends errors to debug chat, it is nil until Start or if it is disabled
+	logSink *telegramSink
+	//config is *TomlConfig, it is replaced on reload
+	config atomic.Value
+	//reloadMu makes reloads one by one. Readers don't lock, they use snapshot from Config.
+	reloadMu sync.Mutex
+	reloaded *reloadNotifier
+
+	//ctx is cancelled by stop on shutdown, background loops stop when it is done
+	ctx  context.Context
+	stop context.CancelFunc
+	//tasks counts running background work, shutdown waits for it before closing storage
+	tasks  *taskTracker
+	albums *albumCollector
+}
+
+//Config returns snapshot of current config. Snapshot is never changed, reload replaces it.
+func (a *App) Config() *TomlConfig {
+	return a.config.Load().(*TomlConfig)
+}
+
+//NewApp creates logger and opens storage for config. Storage is migrated by initStorage,
+//sources and bot are connected by Start or by commands which need them.
+//Background work stops when ctx is done or stop is called.
+func NewApp(ctx context.Context, cfg *TomlConfig) (*App, error) {
+	var err error
+	vk, reddit, telegram, bot := cfg.VK, cfg.Reddit, cfg.Telegram, cfg.TelegramBot
+	a := &App{
+		VK:       &vk,
+		Reddit:   &reddit,
+		Telegram: &telegram,
+		Bot:      &bot,
+		reloaded: newReloadNotifier(),
+		tasks:    &taskTracker{},
+		albums:   newAlbumCollector(),
+	}
+	a.ctx, a.stop = context.WithCancel(ctx)
+	a.Bot.gateway, a.Bot.tasks = newSendGateway(), a.tasks
+
+	a.Log, err = initLogger(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.scorers, err = initScorers(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.I18n.init()
+	if err != nil {
+		return nil, err
+	}
+	a.config.Store(cfg)
+
+	a.Storage, err = NewStorage(cfg.DB.Name, a.Log)
+	if err != nil {
+		return nil, err
+	}
+	a.Storage.publicName = a.publicName
+	a.Storage.fileURL = a.Bot.fileURL
+
+	a.VK.storage, a.VK.log = a.Storage, a.Log
+	a.Reddit.storage, a.Reddit.log = a.Storage, a.Log
+	a.Telegram.storage, a.Telegram.log = a.Storage, a.Log
+	a.Telegram.serveAddress = cfg.ServeAddress
+	a.Bot.log = a.Log
+	return a, nil
+}
+
+//initStorage migrates schema and calculates coefficients for scoring
+func (a *App) initStorage() error {
+	err := a.Storage.Init()
+	if err != nil {
+		return err
+	}
+	err = a.calculateCoeffs()
+	if err != nil {
+		return fmt.Errorf("Cannot calculate coeffs. Reason %s", err)
+	}
+	return nil
+}
+
+//calculateCoeffs recalculates coefficients by votes in production chat
+func (a *App) calculateCoeffs() error {
+	cfg := a.Config()
+	return a.Storage.calculateCoeffs(cfg.TelegramBot.ChatId, &cfg.Metric)
+}
+
+//dump writes all memes with scores of production chat scorer to dump.csv
+func (a *App) dump() error {
+	return a.Storage.Dump(a.getScorer(a.Config().TelegramBot.ChatId))
+}
+
+//flushLog waits until errors queued for debug chat are sent
+func (a *App) flushLog() {
+	if a.logSink != nil {
+		a.logSink.flush(logFlushTimeout)
+	}
+}
+
+//Start connects sources and bot and starts background loops which stop when ctx is done
+func (a *App) Start(ctx context.Context) error {
+	var err error
+	a.logSink, err = addTelegramHook(a.Log, a.Config())
+	if err != nil {
+		return err
+	}
+
+	err = a.Reddit.Init()
+	if err != nil {
+		return err
+	}
+
+	err = a.Bot.Connect(ctx, a.handleUpdate)
+	if err != nil {
+		return err
+	}
+
+	err = a.Telegram.Init()
+	if err != nil {
+		return err
+	}
+
+	a.startUpdates(ctx)
+	a.startQueueScheduler(ctx)
+	a.startRetention(ctx)
+	a.startBackups(ctx)
+	return nil
+}
+
+//update fetches new memes from all sources. Config reloaded meanwhile is used by next update.
+func (a *App) update(ctx context.Context) {
+	cfg := a.Config()
+	a.VK.update(ctx, cfg)
+	a.Reddit.update(ctx, cfg)
+	a.Telegram.update(ctx, cfg)
+	err := a.dump()
+	if err != nil {
+		a.Log.Errorf("Cannot dump memes. Reason %s", err)
+	}
+}
+
+//startUpdates fetches memes from vk every vk.update_timeout minutes and recalculates coefficients
+func (a *App) startUpdates(ctx context.Context) {
+	interval := time.Duration(a.Config().VK.UpdateTimeout) * time.Minute
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-a.configReloaded():
+				newInterval := time.Duration(a.Config().VK.UpdateTimeout) * time.Minute
+				if newInterval != interval {
+					interval = newInterval
+					ticker.Reset(interval)
+				}
+				continue
+			case <-ticker.C:
+			}
+			if !a.tasks.start() {
+				return
+			}
+			a.VK.update(ctx, a.Config())
+			err := a.dump()
+			if err != nil {
+				a.Log.Errorf("Cannot dump memes. Reason %s", err)
+			} else {
+				err = a.calculateCoeffs()
+				if err != nil {
+					a.Log.Errorf("Cannot calculate groups rating. Reason %s", err)
+				}
+			}
+			a.tasks.done()
+		}
+	}()
+}
+
+func (a *App) router() *chi.Mux {
+	router := chi.NewRouter()
+	router.Post("/post", a.topDaylyMemHandler)
+	router.Post("/update/memes", a.updateMemes)
+	router.Get("/download/dump", a.downloadDump)
+	router.Get("/download/stats", a.downloadStats)
+	router.Get("/download/ratings/{id}", a.downloadRatings)
+	router.Get("/download/experiment", a.downloadExperiment)
+	router.Get("/queue", a.getQueue)
+	router.Post("/queue/{memeId}", a.enqueueMeme)
+	router.Post("/queue/item/{id}/pin", a.pinQueueItem)
+	router.Post("/queue/item/{id}/move/{position}", a.moveQueueItem)
+	router.Delete("/queue/item/{id}", a.cancelQueueItem)
+	router.Post("/admin/reload", a.reloadConfigHandler)
+	return router
+}
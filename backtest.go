@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gocarina/gocsv"
+)
+
+//BacktestSlot is what one scorer would do in one past posting slot
+type BacktestSlot struct {
+	Slot          int
+	MsgId         int
+	Time          time.Time
+	TimeEstimated bool
+	Candidates    int
+	PostedMemeId  int
+	Likes         int
+	Dislikes      int
+	LikeRatio     float64
+	Scorer        string
+	PickedMemeId  int
+	PickedScore   float64
+	PostedScore   float64
+	PostedRank    int
+}
+
+//BacktestSummary is aggregated result of one scorer over all slots
+type BacktestSummary struct {
+	Scorer         string
+	Slots          int
+	Hits           int
+	MeanPostedRank float64
+	Pearson        float64
+	Spearman       float64
+}
+
+type BacktestReport struct {
+	ChatId  int64
+	Summary []BacktestSummary
+	Slots   []BacktestSlot
+}
+
+//backtest replays every posting slot of chat against all configured scorers.
+//Coefficients (group and platform ratings, activity) are the current ones,
+//history of them is not stored.
+func (s *Storage) backtest(chatId int64, names []string, scorers *ScorerSet) (*BacktestReport, error) {
+	report := BacktestReport{ChatId: chatId}
+
+	memes, err := s.GetMemes(time.Unix(0, 0))
+	if err != nil {
+		return nil, err
+	}
+	byId := map[int]Meme{}
+	for _, meme := range memes {
+		byId[meme.Id] = meme
+	}
+
+	shownmemes, err := s.getShownMemes(chatId)
+	if err != nil {
+		return nil, err
+	}
+
+	coeffs := s.Coeffs()
+	shown := map[int]bool{}
+	for i, smeme := range shownmemes {
+		posted, ok := byId[smeme.MemeId]
+		if !ok {
+			s.log.Errorf("Cannot find shown meme %d", smeme.MemeId)
+			continue
+		}
+
+		//slots posted before we started to record time are assumed to be posted right after meme appeared
+		slotTime := smeme.Time
+		estimated := slotTime.IsZero()
+		if estimated {
+			slotTime = posted.Time
+		}
+
+		candidates := []Meme{posted}
+		for _, meme := range memes {
+			if meme.Id == posted.Id || shown[meme.Id] {
+				continue
+			}
+			if meme.Time.After(slotTime.Add(-24*time.Hour)) && !meme.Time.After(slotTime) {
+				candidates = append(candidates, meme)
+			}
+		}
+		shown[posted.Id] = true
+
+		likes, dislikes, err := s.getVotes(chatId, smeme.MsgId)
+		if err != nil {
+			return nil, err
+		}
+		likeRatio := 0.0
+		if likes+dislikes > 0 {
+			likeRatio = float64(likes) / float64(likes+dislikes)
+		}
+
+		for _, name := range names {
+			scorer := scorers.all[name]
+			postedScore := scorer.Score(&posted, coeffs, slotTime)
+			picked := posted
+			pickedScore := postedScore
+			rank := 1
+			for j := range candidates {
+				score := scorer.Score(&candidates[j], coeffs, slotTime)
+				if score > postedScore {
+					rank++
+				}
+				if score > pickedScore {
+					picked = candidates[j]
+					pickedScore = score
+				}
+			}
+
+			report.Slots = append(report.Slots, BacktestSlot{
+				Slot:          i,
+				MsgId:         smeme.MsgId,
+				Time:          slotTime,
+				TimeEstimated: estimated,
+				Candidates:    len(candidates),
+				PostedMemeId:  posted.Id,
+				Likes:         likes,
+				Dislikes:      dislikes,
+				LikeRatio:     likeRatio,
+				Scorer:        name,
+				PickedMemeId:  picked.Id,
+				PickedScore:   finite(pickedScore),
+				PostedScore:   finite(postedScore),
+				PostedRank:    rank,
+			})
+		}
+	}
+
+	for _, name := range names {
+		report.Summary = append(report.Summary, summarizeBacktest(name, report.Slots))
+	}
+
+	return &report, nil
+}
+
+func summarizeBacktest(name string, slots []BacktestSlot) BacktestSummary {
+	summary := BacktestSummary{Scorer: name}
+	scores := []float64{}
+	ratios := []float64{}
+	rankSum := 0
+	for _, slot := range slots {
+		if slot.Scorer != name {
+			continue
+		}
+		summary.Slots++
+		rankSum += slot.PostedRank
+		if slot.PickedMemeId == slot.PostedMemeId {
+			summary.Hits++
+		}
+		if slot.Likes+slot.Dislikes > 0 {
+			scores = append(scores, slot.PostedScore)
+			ratios = append(ratios, slot.LikeRatio)
+		}
+	}
+	if summary.Slots > 0 {
+		summary.MeanPostedRank = float64(rankSum) / float64(summary.Slots)
+	}
+	summary.Pearson = pearson(scores, ratios)
+	summary.Spearman = pearson(ranks(scores), ranks(ratios))
+	return summary
+}
+
+//finite replaces NaN and Inf, which come from division by zero activity, with 0 so report can be encoded
+func finite(x float64) float64 {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return 0
+	}
+	return x
+}
+
+//pearson returns correlation coefficient or 0 if it is undefined
+func pearson(x, y []float64) float64 {
+	n := float64(len(x))
+	if len(x) < 2 {
+		return 0
+	}
+	var meanX, meanY float64
+	for i := range x {
+		meanX += x[i]
+		meanY += y[i]
+	}
+	meanX /= n
+	meanY /= n
+
+	var cov, varX, varY float64
+	for i := range x {
+		cov += (x[i] - meanX) * (y[i] - meanY)
+		varX += (x[i] - meanX) * (x[i] - meanX)
+		varY += (y[i] - meanY) * (y[i] - meanY)
+	}
+	if varX == 0 || varY == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varX*varY)
+}
+
+//ranks returns rank of every value, ties get average rank
+func ranks(values []float64) []float64 {
+	idx := make([]int, len(values))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(a, b int) bool { return values[idx[a]] < values[idx[b]] })
+
+	res := make([]float64, len(values))
+	for i := 0; i < len(idx); {
+		j := i
+		for j+1 < len(idx) && values[idx[j+1]] == values[idx[i]] {
+			j++
+		}
+		rank := float64(i+j)/2 + 1
+		for k := i; k <= j; k++ {
+			res[idx[k]] = rank
+		}
+		i = j + 1
+	}
+	return res
+}
+
+//runBacktest is entry point for `fedormemes backtest`
+func (a *App) runBacktest(args []string) error {
+	var (
+		chatId int64
+		format string
+		output string
+	)
+	flags := flag.NewFlagSet("backtest", flag.ContinueOnError)
+	flags.Int64Var(&chatId, "chat", a.Config().TelegramBot.ChatId, "Chat which history is replayed")
+	flags.StringVar(&format, "format", "csv", "Report format: csv (slots) or json (summary and slots)")
+	flags.StringVar(&output, "o", "", "Report file. Stdout by default")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	scorers := a.currentScorers()
+	names := []string{}
+	for name := range scorers.all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report, err := a.Storage.backtest(chatId, names, scorers)
+	if err != nil {
+		return fmt.Errorf("Cannot backtest. Reason %s", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("Cannot create report file. Reason %s", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "csv":
+		err = gocsv.Marshal(&report.Slots, w)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	default:
+		return fmt.Errorf("Unknown format %s", format)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot write report. Reason %s", err)
+	}
+
+	for _, summary := range report.Summary {
+		fmt.Fprintf(os.Stderr, "%s: slots %d, hits %d, mean posted rank %.2f, pearson %.3f, spearman %.3f\n",
+			summary.Scorer, summary.Slots, summary.Hits, summary.MeanPostedRank, summary.Pearson, summary.Spearman)
+	}
+
+	return nil
+}
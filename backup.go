@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	//backupStepPages is how many pages are copied at once, db is not locked between steps
+	backupStepPages = 256
+
+	backupPattern = "fedormemes-*.db"
+
+	//maxDocumentSize is limit of Bot API for sent files
+	maxDocumentSize = 50 << 20
+)
+
+//BackupConfig is [backup] section. Interval is in hours, Keep is number of backups left after rotation.
+type BackupConfig struct {
+	Enabled     bool
+	Dir         string
+	Interval    int
+	Keep        int
+	SendToDebug bool
+}
+
+func (c *BackupConfig) dir() string {
+	if c.Dir == "" {
+		return "backups"
+	}
+	return c.Dir
+}
+
+func (c *BackupConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.Interval) * time.Hour
+}
+
+func (c *BackupConfig) keep() int {
+	if c.Keep <= 0 {
+		return 7
+	}
+	return c.Keep
+}
+
+//copyDB copies src to dest with online backup API, src can be used by other connections while it runs
+func copyDB(ctx context.Context, dest, src *sql.DB) error {
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("Cannot get connection of backup destination. Reason %s", err)
+	}
+	defer destConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("Cannot get connection of backup source. Reason %s", err)
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriver interface{}) error {
+		return srcConn.Raw(func(srcDriver interface{}) error {
+			backup, err := destDriver.(*sqlite3.SQLiteConn).Backup("main", srcDriver.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return fmt.Errorf("Cannot start backup. Reason %s", err)
+			}
+			for {
+				done, err := backup.Step(backupStepPages)
+				if err != nil {
+					backup.Finish()
+					return fmt.Errorf("Cannot copy pages. Reason %s", err)
+				}
+				if done {
+					break
+				}
+				if ctx.Err() != nil {
+					backup.Finish()
+					return ctx.Err()
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			err = backup.Finish()
+			if err != nil {
+				return fmt.Errorf("Cannot finish backup. Reason %s", err)
+			}
+			return nil
+		})
+	})
+}
+
+//Backup writes copy of db to new file path
+func (s *Storage) Backup(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("Backup %s already exists", path)
+	}
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return fmt.Errorf("Cannot open backup %s. Reason %s", path, err)
+	}
+	defer dest.Close()
+
+	err = copyDB(ctx, dest, s.DB)
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("Cannot backup db to %s. Reason %s", path, err)
+	}
+	return nil
+}
+
+//checkBackup verifies that backup is readable db with schema this version can migrate
+func checkBackup(db *sql.DB) error {
+	version := 0
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("Cannot get schema version. Reason %s", err)
+	}
+	if version == 0 {
+		return fmt.Errorf("Backup has no schema version, it is not fedormemes db")
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("Backup schema version %d is newer than %d, update fedormemes", version, schemaVersion)
+	}
+
+	result := ""
+	err = db.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return fmt.Errorf("Cannot check integrity. Reason %s", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("Backup is corrupted: %s", result)
+	}
+	return nil
+}
+
+//Restore replaces db by backup from path. Init has to be called after it to migrate schema of backup.
+func (s *Storage) Restore(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("Cannot open backup. Reason %s", err)
+	}
+	src, err := sql.Open("sqlite3", "file:"+(&url.URL{Path: path}).EscapedPath()+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("Cannot open backup %s. Reason %s", path, err)
+	}
+	defer src.Close()
+
+	err = checkBackup(src)
+	if err != nil {
+		return err
+	}
+
+	err = copyDB(ctx, s.DB, src)
+	if err != nil {
+		return fmt.Errorf("Cannot restore db from %s. Reason %s", path, err)
+	}
+	return nil
+}
+
+//rotateBackups removes oldest backups in dir so only keep are left
+func rotateBackups(dir string, keep int) error {
+	files, err := filepath.Glob(filepath.Join(dir, backupPattern))
+	if err != nil {
+		return fmt.Errorf("Cannot list backups. Reason %s", err)
+	}
+	//names contain time, so they are sorted by it
+	sort.Strings(files)
+	for len(files) > keep {
+		err = os.Remove(files[0])
+		if err != nil {
+			return fmt.Errorf("Cannot remove old backup. Reason %s", err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+//SendDocument uploads file to chat
+func (b *TelegramBot) SendDocument(chatId int64, path, caption string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Cannot open document. Reason %s", err)
+	}
+	if stat.Size() > maxDocumentSize {
+		return fmt.Errorf("Document %s is bigger than %d bytes", path, maxDocumentSize)
+	}
+
+	return b.send(chatId, func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Cannot open document. Reason %s", err)
+		}
+		defer f.Close()
+		args := url.Values{}
+		args.Set("chat_id", strconv.FormatInt(chatId, 10))
+		args.Set("caption", caption)
+		_, err = b.bot.Upload("sendDocument", "document", filepath.Base(path), f, uploadArgs(args))
+		return err
+	})
+}
+
+//backup makes backup in backup dir, removes old ones and sends new one to debug chat if configured
+func (a *App) backup(ctx context.Context) (string, error) {
+	cfg := a.Config().Backup
+	err := os.MkdirAll(cfg.dir(), 0755)
+	if err != nil {
+		return "", fmt.Errorf("Cannot create backup dir. Reason %s", err)
+	}
+	path := filepath.Join(cfg.dir(), fmt.Sprintf("fedormemes-%s.db", time.Now().Format("20060102-150405")))
+	err = a.Storage.Backup(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	err = rotateBackups(cfg.dir(), cfg.keep())
+	if err != nil {
+		a.Log.Errorf("%s", err)
+	}
+
+	if cfg.SendToDebug && a.Bot.bot != nil {
+		err = a.Bot.SendDocument(a.Config().TelegramBot.ChatIdDebug, path, fmt.Sprintf("Backup %s", filepath.Base(path)))
+		if err != nil {
+			a.Log.Errorf("Cannot send backup to debug chat. Reason %s", err)
+		}
+	}
+	return path, nil
+}
+
+//startBackups makes backup every backup.interval hours
+func (a *App) startBackups(ctx context.Context) {
+	if !a.Config().Backup.Enabled {
+		return
+	}
+	interval := a.Config().Backup.interval()
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-a.configReloaded():
+				newInterval := a.Config().Backup.interval()
+				if newInterval != interval {
+					interval = newInterval
+					ticker.Reset(interval)
+				}
+				continue
+			case <-ticker.C:
+			}
+			if !a.tasks.start() {
+				return
+			}
+			path, err := a.backup(ctx)
+			if err != nil {
+				a.Log.Errorf("Cannot make backup. Reason %s", err)
+			} else {
+				a.Log.Infof("Made backup %s", path)
+			}
+			a.tasks.done()
+		}
+	}()
+}
+
+//runBackup is backup command. Without -o backup is made in backup dir with rotation.
+func runBackup(a *App, args []string) error {
+	var output string
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.StringVar(&output, "o", "", "Backup file. By default new file in backup.dir")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if output != "" {
+		return a.Storage.Backup(a.ctx, output)
+	}
+	path, err := a.backup(a.ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
+
+//runRestore is restore command. Bot must be stopped while db is restored.
+func runRestore(a *App, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: fedormemes restore <backup file>")
+	}
+
+	err = a.Storage.Restore(a.ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return a.initStorage()
+}
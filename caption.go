@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	ParseModeHTML       = "HTML"
+	ParseModeMarkdownV2 = "MarkdownV2"
+	ParseModePlain      = "plain"
+)
+
+//CaptionData is available in caption templates. Strings are already escaped for parse mode of chat.
+type CaptionData struct {
+	Id          int
+	Public      string
+	Platform    string
+	Author      string
+	Link        string
+	Description string
+	Score       string
+	Posted      string
+}
+
+func isParseMode(mode string) bool {
+	switch mode {
+	case "", ParseModeHTML, ParseModeMarkdownV2, ParseModePlain:
+		return true
+	}
+	return false
+}
+
+//chatParseMode returns parse mode of chat, HTML by default
+func (c *I18nConfig) chatParseMode(chatId int64) string {
+	if chat, ok := c.Chats[strconv.FormatInt(chatId, 10)]; ok && chat.ParseMode != "" {
+		return chat.ParseMode
+	}
+	if c.ParseMode != "" {
+		return c.ParseMode
+	}
+	return ParseModeHTML
+}
+
+var markdownV2Escaper = strings.NewReplacer(
+	`\`, `\\`, "_", `\_`, "*", `\*`, "[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`, "~", `\~`, "`", "\\`",
+	">", `\>`, "#", `\#`, "+", `\+`, "-", `\-`, "=", `\=`, "|", `\|`, "{", `\{`, "}", `\}`, ".", `\.`, "!", `\!`,
+)
+
+func escape(mode, text string) string {
+	switch mode {
+	case ParseModeHTML:
+		return html.EscapeString(text)
+	case ParseModeMarkdownV2:
+		return markdownV2Escaper.Replace(text)
+	}
+	return text
+}
+
+//linkFunc renders link in parse mode. Text and url are escaped already.
+func linkFunc(mode string) func(text, url string) string {
+	return func(text, url string) string {
+		if url == "" {
+			return text
+		}
+		switch mode {
+		case ParseModeHTML:
+			return fmt.Sprintf(`<a href="%s">%s</a>`, url, text)
+		case ParseModeMarkdownV2:
+			return fmt.Sprintf("[%s](%s)", text, url)
+		}
+		return fmt.Sprintf("%s %s", text, url)
+	}
+}
+
+func newCaptionTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(template.FuncMap{"link": linkFunc("")}).Parse(text)
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+//visibleText is text of rendered caption as Telegram shows and counts it: without tags,
+//link urls and escaping of parse mode
+func visibleText(mode, text string) string {
+	switch mode {
+	case ParseModeHTML:
+		return html.UnescapeString(htmlTag.ReplaceAllString(text, ""))
+	case ParseModeMarkdownV2:
+		//in valid MarkdownV2 every special character of text is escaped, so unescaped ones are markup
+		res := []rune{}
+		runes := []rune(text)
+		for i := 0; i < len(runes); i++ {
+			r := runes[i]
+			switch {
+			case r == '\\' && i+1 < len(runes):
+				i++
+				res = append(res, runes[i])
+			case r == ']' && i+1 < len(runes) && runes[i+1] == '(':
+				//url of link is skipped up to unescaped )
+				for i += 2; i < len(runes) && runes[i] != ')'; i++ {
+					if runes[i] == '\\' {
+						i++
+					}
+				}
+			case strings.ContainsRune("_*[]()~`>#+-=|{}.!", r):
+			default:
+				res = append(res, r)
+			}
+		}
+		return string(res)
+	}
+	return text
+}
+
+//truncate cuts text to size runes
+func truncate(text string, size int) string {
+	runes := []rune(text)
+	if len(runes) <= size {
+		return text
+	}
+	return string(runes[:size-1]) + "…"
+}
+
+//Caption renders caption of meme for chat. Template of chat replaces "caption" key if configured, otherwise key from catalog is used.
+//Description of meme is shortened so caption fits in MEDIA_CAPTION_SIZE.
+func (a *App) Caption(chatId int64, key string, m *Meme, score float64) (MemeCaption, error) {
+	i18n := &a.Config().I18n
+	locale := i18n.chatLocale(chatId)
+	mode := i18n.chatParseMode(chatId)
+	tmpl, ok := i18n.templates[strconv.FormatInt(chatId, 10)+"/"+key]
+	if !ok {
+		tmpl, ok = i18n.templates[locale+"/"+key]
+	}
+	if !ok {
+		tmpl, ok = i18n.templates[DefaultLocale+"/"+key]
+	}
+	if !ok {
+		return MemeCaption{}, fmt.Errorf("No caption template %s", key)
+	}
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return MemeCaption{}, fmt.Errorf("Cannot clone caption template. Reason %s", err)
+	}
+
+	public, link, posted := a.publicName(m), a.sourceLink(m), HumanTime(m.Time, locale)
+	renderMode := func(mode, description string) (MemeCaption, error) {
+		tmpl.Funcs(template.FuncMap{"link": linkFunc(mode)})
+		data := CaptionData{
+			Id:          m.Id,
+			Public:      escape(mode, public),
+			Platform:    escape(mode, m.Platform),
+			Author:      escape(mode, m.Author),
+			Link:        escape(mode, link),
+			Description: escape(mode, description),
+			Score:       escape(mode, fmt.Sprintf("%.2f", score)),
+			Posted:      escape(mode, posted),
+		}
+		buf := bytes.NewBuffer([]byte{})
+		err := tmpl.Execute(buf, data)
+		if err != nil {
+			return MemeCaption{}, fmt.Errorf("Cannot render caption for chat %d. Reason %s", chatId, err)
+		}
+		caption := MemeCaption{Text: buf.String(), ParseMode: mode}
+		if mode == ParseModePlain {
+			caption.ParseMode = ""
+		}
+		return caption, nil
+	}
+	render := func(description string) (MemeCaption, error) {
+		return renderMode(mode, description)
+	}
+	//Telegram limits length of text after parsing, so markup is not counted
+	fits := func(caption MemeCaption) bool {
+		return len([]rune(visibleText(mode, caption.Text))) <= MEDIA_CAPTION_SIZE
+	}
+
+	caption, err := render(m.Description)
+	if err != nil || fits(caption) {
+		return caption, err
+	}
+
+	//longest prefix of description which fits, escaping makes text longer so it is searched by rendering
+	description := []rune(m.Description)
+	lo, hi := 0, len(description)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		caption, err = render(string(description[:mid]) + "…")
+		if err != nil {
+			return caption, err
+		}
+		if fits(caption) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	if lo > 0 {
+		return render(string(description[:lo]) + "…")
+	}
+
+	caption, err = render("")
+	if err != nil || fits(caption) {
+		return caption, err
+	}
+	//markup cannot be cut safely, so too long caption is rendered and cut as plain text
+	a.Log.Errorf("Caption template for chat %d is longer than %d", chatId, MEDIA_CAPTION_SIZE)
+	caption, err = renderMode(ParseModePlain, m.Description)
+	if err != nil {
+		return caption, err
+	}
+	caption.Text = truncate(caption.Text, MEDIA_CAPTION_SIZE)
+	return caption, nil
+}
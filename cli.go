@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/naoina/toml"
+)
+
+//command is subcommand of fedormemes. Commands connect only services they use, so maintenance works offline.
+type command struct {
+	name  string
+	usage string
+	//migrate means storage is migrated before command runs
+	migrate bool
+	run     func(a *App, args []string) error
+}
+
+var commands = []command{
+	{"serve", "run bot, fetchers and http api (default)", true, runServe},
+	{"fetch", "[-source vk|reddit|telegram] fetch new memes once", true, runFetch},
+	{"post", "post best meme to channel", true, runPost},
+	{"rescore", "recalculate ratings and activity, write dump.csv", true, runRescore},
+	{"dedupe-check", "[-distance n] <url> find memes with similar picture", true, runDedupeCheck},
+	{"export", "[-o file] write memes with hashes as json lines", true, runExport},
+	{"import", "[file] read memes exported by export, stdin by default", true, runImport},
+	{"migrate", "create and update db schema", true, runMigrate},
+	{"auth", "telegram: log in to MTProto and save credentials", false, runAuth},
+	{"backtest", "[-chat id] [-format csv|json] [-o file] replay posting history against scorers", true, runBacktestCommand},
+	{"backup", "[-o file] make online backup of db", false, runBackup},
+	{"restore", "<file> replace db by backup", false, runRestore},
+	{"config", "check: validate config and print it with defaults and masked secrets", false, runConfig},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: fedormemes [-c config.toml] [-v] <command> [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-13s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+//runConfig prints effective config. Config is already validated when it is loaded.
+func runConfig(a *App, args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return fmt.Errorf("Usage: fedormemes config check")
+	}
+
+	out, err := toml.Marshal(*a.Config().masked())
+	if err != nil {
+		return fmt.Errorf("Cannot encode config. Reason %s", err)
+	}
+	fmt.Print(string(out))
+	return nil
+}
+
+func runBacktestCommand(a *App, args []string) error {
+	return a.runBacktest(args)
+}
+
+func runFetch(a *App, args []string) error {
+	var source string
+	flags := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	flags.StringVar(&source, "source", "", "Fetch only from vk, reddit or telegram")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	switch source {
+	case "":
+		err = a.Reddit.Init()
+		if err == nil {
+			err = a.Telegram.Init()
+		}
+		if err == nil {
+			a.update(a.ctx)
+		}
+	case "vk":
+		a.VK.update(a.ctx, a.Config())
+	case "reddit":
+		err = a.Reddit.Init()
+		if err == nil {
+			a.Reddit.update(a.ctx, a.Config())
+		}
+	case "telegram":
+		err = a.Telegram.Init()
+		if err == nil {
+			a.Telegram.update(a.ctx, a.Config())
+		}
+	default:
+		return fmt.Errorf("Unknown source %s", source)
+	}
+	if err != nil {
+		return err
+	}
+	return a.calculateCoeffs()
+}
+
+func runPost(a *App, args []string) error {
+	flags := flag.NewFlagSet("post", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "show what would be posted without sending anything")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		previews, err := a.previewTopMeme()
+		if err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(previews, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Cannot encode preview. Reason %s", err)
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	err = a.Bot.login()
+	if err != nil {
+		return err
+	}
+	meme, err := a.postTopMeme()
+	if err != nil {
+		return err
+	}
+	if meme != nil {
+		fmt.Printf("Posted meme %d from %s\n", meme.Id, a.publicName(meme))
+	}
+	return nil
+}
+
+func runRescore(a *App, args []string) error {
+	err := flag.NewFlagSet("rescore", flag.ContinueOnError).Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = a.calculateCoeffs()
+	if err != nil {
+		return err
+	}
+	coeffs := a.Storage.Coeffs()
+	platforms := []string{}
+	for platform := range coeffs.PlatformActivity {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	for _, platform := range platforms {
+		fmt.Printf("%s: groups %d, rating %.3f, activity %.3f\n", platform, len(coeffs.GroupActivity[platform]),
+			coeffs.PlatformRatings[platform].Value, coeffs.PlatformActivity[platform])
+	}
+	return a.dump()
+}
+
+func runDedupeCheck(a *App, args []string) error {
+	var distance int
+	flags := flag.NewFlagSet("dedupe-check", flag.ContinueOnError)
+	flags.IntVar(&distance, "distance", a.Config().Collision.Distance, "Maximal distance of similar hashes")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: fedormemes dedupe-check [-distance n] <url>")
+	}
+
+	meme := Meme{Pictures: []string{flags.Arg(0)}}
+	hash, err := a.Storage.getHash(a.ctx, &meme)
+	if err != nil {
+		return err
+	}
+	hashes, err := a.Storage.getHashes()
+	if err != nil {
+		return err
+	}
+
+	found := 0
+	for _, h := range hashes {
+		dist, err := h.Hash.Distance(hash)
+		if err != nil || dist > distance {
+			continue
+		}
+		found++
+		if h.MemeId == 0 {
+			fmt.Printf("distance %d: removed meme %q\n", dist, h.Description)
+			continue
+		}
+		m, err := a.Storage.GetMemeById(h.MemeId)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("distance %d: meme %d from %s %s %q\n", dist, m.Id, a.publicName(m), a.sourceLink(m), m.Description)
+	}
+	if found == 0 {
+		fmt.Println("No similar memes")
+	}
+	return nil
+}
+
+//ExportedMeme is line of export file. Hash lets import skip downloading pictures.
+type ExportedMeme struct {
+	Meme
+	Hash string `json:",omitempty"`
+}
+
+func runExport(a *App, args []string) error {
+	var output string
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.StringVar(&output, "o", "", "Export file. Stdout by default")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("Cannot create export file. Reason %s", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	memes, err := a.Storage.exportMemes()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, meme := range memes {
+		err = enc.Encode(meme)
+		if err != nil {
+			return fmt.Errorf("Cannot write meme %d. Reason %s", meme.Id, err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d memes\n", len(memes))
+	return nil
+}
+
+func runImport(a *App, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("Cannot open import file. Reason %s", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	imported, skipped := 0, 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		meme := ExportedMeme{}
+		err = json.Unmarshal(scanner.Bytes(), &meme)
+		if err != nil {
+			return fmt.Errorf("Cannot parse line %d. Reason %s", line, err)
+		}
+		id, err := a.Storage.importMeme(a.ctx, meme, a.Config().Collision.Distance)
+		if err != nil {
+			return fmt.Errorf("Cannot import line %d. Reason %s", line, err)
+		}
+		if id == 0 {
+			skipped++
+		} else {
+			imported++
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("Cannot read import file. Reason %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d memes, skipped %d existing\n", imported, skipped)
+	return nil
+}
+
+func runMigrate(a *App, args []string) error {
+	err := flag.NewFlagSet("migrate", flag.ContinueOnError).Parse(args)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Schema version %d\n", schemaVersion)
+	return nil
+}
+
+func runAuth(a *App, args []string) error {
+	if len(args) != 1 || args[0] != "telegram" {
+		return fmt.Errorf("Usage: fedormemes auth telegram")
+	}
+	err := a.Telegram.Init()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Authorized in telegram")
+	return nil
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"strings"
+	"text/template"
 
 	"github.com/naoina/toml"
 )
@@ -12,10 +16,7 @@ type TomlConfig struct {
 	Title        string
 	ServeAddress string
 
-	Metric struct {
-		Coeff              float64
-		DefaultGroupRating map[string]float64
-	}
+	Metric    MetricConfig
 	Collision struct {
 		Distance int
 	}
@@ -24,28 +25,22 @@ type TomlConfig struct {
 	Reddit      Reddit
 	Telegram    Telegram
 	TelegramBot TelegramBot
+	Moderation  ModerationConfig
+	Queue       QueueConfig
+	Submission  SubmissionConfig
+	I18n        I18nConfig
+	Retention   RetentionConfig
+	Backup      BackupConfig
 	DB          struct {
 		Name          string
 		UpdateTimeout int
 	}
 
-	Log struct {
-		Type        string
-		NetworkType string
-		Host        string
-		Severity    string
-		Facility    string
-		Port        string
-		FilePath    string
-		FileName    string
-		DebugMode   bool
-	}
-}
+	Log LogConfig
 
-var (
-	//Config struct
-	Config *TomlConfig
-)
+	//scorers are built from Metric when config is loaded by App
+	scorers *ScorerSet
+}
 
 func getConfig(configFileName string) (*TomlConfig, error) {
 	var config TomlConfig
@@ -61,5 +56,180 @@ func getConfig(configFileName string) (*TomlConfig, error) {
 	if err := toml.Unmarshal(buf, &config); err != nil {
 		return nil, err
 	}
+
+	err = config.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+	config.setDefaults()
+	err = config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("Wrong config %s. %s", configFileName, err)
+	}
 	return &config, nil
 }
+
+//secretField is config value which can be set by environment variable and is masked in output
+type secretField struct {
+	env   string
+	value *string
+}
+
+func (c *TomlConfig) secrets() []secretField {
+	return []secretField{
+		{"FEDORMEMES_VK_TOKEN", &c.VK.Token},
+		{"FEDORMEMES_REDDIT_SECRET", &c.Reddit.Secret},
+		{"FEDORMEMES_REDDIT_PASSWORD", &c.Reddit.Password},
+		{"FEDORMEMES_TELEGRAM_APP_HASH", &c.Telegram.AppHash},
+		{"FEDORMEMES_TELEGRAM_PHONE_NUMBER", &c.Telegram.PhoneNumber},
+		{"FEDORMEMES_TELEGRAM_BOT_TOKEN", &c.TelegramBot.Token},
+	}
+}
+
+//applyEnv overrides values from file by FEDORMEMES_* environment variables
+func (c *TomlConfig) applyEnv() error {
+	for _, secret := range c.secrets() {
+		if value, ok := os.LookupEnv(secret.env); ok {
+			*secret.value = value
+		}
+	}
+
+	vars := []struct {
+		env   string
+		value *string
+	}{
+		{"FEDORMEMES_REDDIT_APP_ID", &c.Reddit.AppId},
+		{"FEDORMEMES_REDDIT_USERNAME", &c.Reddit.Username},
+		{"FEDORMEMES_DB_NAME", &c.DB.Name},
+	}
+	for _, v := range vars {
+		if value, ok := os.LookupEnv(v.env); ok {
+			*v.value = value
+		}
+	}
+
+	if value, ok := os.LookupEnv("FEDORMEMES_TELEGRAM_APP_ID"); ok {
+		var id int32
+		_, err := fmt.Sscan(value, &id)
+		if err != nil {
+			return fmt.Errorf("Wrong FEDORMEMES_TELEGRAM_APP_ID %s. Reason %s", value, err)
+		}
+		c.Telegram.AppID = id
+	}
+	return nil
+}
+
+//setDefaults fills values which are not set in config. Defaults are documented in config.toml.example.
+func (c *TomlConfig) setDefaults() {
+	if c.ServeAddress == "" {
+		c.ServeAddress = ":3364"
+	}
+	if c.Metric.Coeff == 0 {
+		c.Metric.Coeff = 48
+	}
+	if c.DB.Name == "" {
+		c.DB.Name = "fedormemes.db"
+	}
+
+	if c.VK.ServerAddress == "" {
+		c.VK.ServerAddress = "https://api.vk.com/method/"
+	}
+	if c.VK.VkApiVersion == "" {
+		c.VK.VkApiVersion = "5.75"
+	}
+	if c.VK.RequestTimeout == 0 {
+		c.VK.RequestTimeout = 200
+	}
+	if c.VK.LookingDuration == 0 {
+		c.VK.LookingDuration = 72
+	}
+	if c.VK.UpdateTimeout == 0 {
+		c.VK.UpdateTimeout = 10
+	}
+
+	if c.Reddit.UserAgent == "" {
+		c.Reddit.UserAgent = "Fedor-memes-bot"
+	}
+	if c.Reddit.LookingDuration == 0 {
+		c.Reddit.LookingDuration = 24
+	}
+
+	if c.Telegram.IP == "" {
+		c.Telegram.IP = "149.154.167.50"
+	}
+	if c.Telegram.Port == 0 {
+		c.Telegram.Port = 443
+	}
+	if c.Telegram.LookingDuration == 0 {
+		c.Telegram.LookingDuration = 24
+	}
+	if c.Telegram.LoadStep == 0 {
+		c.Telegram.LoadStep = 100
+	}
+}
+
+//validate checks values which would break bot at runtime and reports all of them at once
+func (c *TomlConfig) validate() error {
+	errs := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Metric.Coeff > 0, "metric.coeff should be positive, got %f", c.Metric.Coeff)
+	check(c.Metric.ActivityWindow >= 0, "metric.activity_window should not be negative, got %d", c.Metric.ActivityWindow)
+	check(c.Collision.Distance >= 0, "collision.distance should not be negative, got %d", c.Collision.Distance)
+
+	check(c.VK.RequestTimeout > 0, "vk.request_timeout should be positive, got %d", c.VK.RequestTimeout)
+	check(c.VK.LookingDuration > 0, "vk.looking_duration should be positive, got %d", c.VK.LookingDuration)
+	check(c.VK.UpdateTimeout > 0, "vk.update_timeout should be positive, got %d", c.VK.UpdateTimeout)
+	if c.VK.SpamFilter != "" {
+		_, err := regexp.Compile(c.VK.SpamFilter)
+		check(err == nil, "vk.spam_filter is wrong regexp. Reason %s", err)
+	}
+	if c.VK.LinkFormat != "" {
+		_, err := template.New("link").Parse(c.VK.LinkFormat)
+		check(err == nil, "vk.link_format is wrong template. Reason %s", err)
+	}
+
+	check(c.Reddit.LookingDuration > 0, "reddit.looking_duration should be positive, got %d", c.Reddit.LookingDuration)
+
+	check(c.Telegram.LookingDuration > 0, "telegram.looking_duration should be positive, got %d", c.Telegram.LookingDuration)
+	check(c.Telegram.LoadStep > 0 && c.Telegram.LoadStep <= 100, "telegram.load_step should be in [1, 100], got %d", c.Telegram.LoadStep)
+	check(c.Telegram.Port > 0 && c.Telegram.Port < 65536, "telegram.port should be in [1, 65535], got %d", c.Telegram.Port)
+
+	check(c.TelegramBot.Token == "" || c.TelegramBot.ChatId != 0, "telegram_bot.chat_id is required when token is set")
+	check(c.TelegramBot.Workers >= 0, "telegram_bot.workers should not be negative, got %d", c.TelegramBot.Workers)
+
+	check(c.Moderation.Candidates >= 0, "moderation.candidates should not be negative, got %d", c.Moderation.Candidates)
+	check(c.Moderation.AutoApprove >= 0, "moderation.auto_approve should not be negative, got %d", c.Moderation.AutoApprove)
+	check(c.Queue.CheckInterval >= 0, "queue.check_interval should not be negative, got %d", c.Queue.CheckInterval)
+	check(c.Queue.MaxAttempts >= 0, "queue.max_attempts should not be negative, got %d", c.Queue.MaxAttempts)
+	check(c.Queue.Backoff >= 0, "queue.backoff should not be negative, got %d", c.Queue.Backoff)
+	check(c.Submission.Limit >= 0, "submission.limit should not be negative, got %d", c.Submission.Limit)
+	check(c.Submission.Window >= 0, "submission.window should not be negative, got %d", c.Submission.Window)
+	check(c.Retention.Days >= 0, "retention.days should not be negative, got %d", c.Retention.Days)
+	check(c.Retention.ArchiveDays >= 0, "retention.archive_days should not be negative, got %d", c.Retention.ArchiveDays)
+	check(c.Retention.Interval >= 0, "retention.interval should not be negative, got %d", c.Retention.Interval)
+	check(c.Backup.Interval >= 0, "backup.interval should not be negative, got %d", c.Backup.Interval)
+	check(c.Backup.Keep >= 0, "backup.keep should not be negative, got %d", c.Backup.Keep)
+	err := c.Log.validate()
+	check(err == nil, "log: %s", err)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Errors:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+//masked returns copy of config with secrets replaced by stars
+func (c *TomlConfig) masked() *TomlConfig {
+	res := *c
+	for _, secret := range res.secrets() {
+		if *secret.value != "" {
+			*secret.value = "***"
+		}
+	}
+	return &res
+}
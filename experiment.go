@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+const (
+	ArmA = "A"
+	ArmB = "B"
+)
+
+//ExperimentConfig is [metric.experiment] section. Split is share of slots posted by scorer B.
+type ExperimentConfig struct {
+	Enabled bool
+	A       string
+	B       string
+	Split   float64
+}
+
+//ExperimentArm is result of one experiment arm
+type ExperimentArm struct {
+	Arm      string
+	Scorer   string
+	Slots    int
+	Likes    int
+	Dislikes int
+	LikeRate float64
+	Lower    float64
+	Upper    float64
+}
+
+func (e *ExperimentConfig) validate(available map[string]Scorer) error {
+	if !e.Enabled {
+		return nil
+	}
+	if _, ok := available[e.A]; !ok {
+		return fmt.Errorf("Scorer %s for experiment arm A is not configured", e.A)
+	}
+	if _, ok := available[e.B]; !ok {
+		return fmt.Errorf("Scorer %s for experiment arm B is not configured", e.B)
+	}
+	if e.A == e.B {
+		return fmt.Errorf("Experiment arms A and B use the same scorer %s", e.A)
+	}
+	if e.Split < 0 || e.Split > 1 {
+		return fmt.Errorf("Experiment split should be in [0, 1], got %f", e.Split)
+	}
+	return nil
+}
+
+//scorerChoice is scorer which can get posting slot and probability that it gets it
+type scorerChoice struct {
+	scorer Scorer
+	arm    string
+	chance float64
+}
+
+//scorerChoices returns scorers which can get next posting slot of chat.
+//If experiment is enabled, they are scorers of arms A and B, otherwise only scorer of chat.
+func (a *App) scorerChoices(chatId int64) []scorerChoice {
+	set := a.currentScorers()
+	e := set.experiment
+	if !e.Enabled || chatId != a.Config().TelegramBot.ChatId {
+		return []scorerChoice{{set.get(chatId), "", 1}}
+	}
+	return []scorerChoice{
+		{set.all[e.A], ArmA, 1 - e.Split},
+		{set.all[e.B], ArmB, e.Split},
+	}
+}
+
+//chooseScorer returns scorer for next posting slot of chat.
+//If experiment is enabled, slot is assigned to arm A or B randomly.
+func (a *App) chooseScorer(chatId int64) (Scorer, string) {
+	choices := a.scorerChoices(chatId)
+	r := rand.Float64()
+	for _, choice := range choices[:len(choices)-1] {
+		if r < choice.chance {
+			return choice.scorer, choice.arm
+		}
+		r -= choice.chance
+	}
+	last := choices[len(choices)-1]
+	return last.scorer, last.arm
+}
+
+//wilson returns 95% Wilson score interval for share of likes
+func wilson(likes, total int) (float64, float64) {
+	if total == 0 {
+		return 0, 1
+	}
+	const z = 1.96
+	n := float64(total)
+	p := float64(likes) / n
+	denom := 1 + z*z/n
+	center := (p + z*z/(2*n)) / denom
+	half := z * math.Sqrt(p*(1-p)/n+z*z/(4*n*n)) / denom
+	return center - half, center + half
+}
+
+func (s *Storage) getExperimentReport(chatId int64) ([]ExperimentArm, error) {
+	res := []ExperimentArm{}
+	rows, err := s.DB.Query(`select sm.arm, ifnull(sm.scorer, ''), count(distinct sm.msg_id),
+	ifnull(sum(case when cm.btn_id = 0 then 1 else 0 end), 0),
+	ifnull(sum(case when cm.btn_id = 1 then 1 else 0 end), 0)
+from shown_memes as sm left join chat_metadata as cm on cm.chat_id = sm.chat_id and cm.msg_id = sm.msg_id
+where sm.chat_id = ? and sm.msg_id != 0 and sm.arm is not null
+group by sm.arm, sm.scorer
+order by sm.arm, sm.scorer`, chatId)
+	if err != nil {
+		return res, fmt.Errorf("Cannot get experiment results for chat %d. Reason %s", chatId, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		arm := ExperimentArm{}
+		err = rows.Scan(&arm.Arm, &arm.Scorer, &arm.Slots, &arm.Likes, &arm.Dislikes)
+		if err != nil {
+			return res, fmt.Errorf("Cannot scan experiment results. Reason %s", err)
+		}
+		if arm.Likes+arm.Dislikes > 0 {
+			arm.LikeRate = float64(arm.Likes) / float64(arm.Likes+arm.Dislikes)
+		}
+		arm.Lower, arm.Upper = wilson(arm.Likes, arm.Likes+arm.Dislikes)
+		res = append(res, arm)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//expression is compiled formula which can be evaluated against set of variables
+type expression func(vars map[string]float64) float64
+
+type exprFunc struct {
+	args int
+	fn   func(args []float64) float64
+}
+
+var exprFuncs = map[string]exprFunc{
+	"exp":  {1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"log":  {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"sqrt": {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"abs":  {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"pow":  {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"min":  {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max":  {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+}
+
+type exprParser struct {
+	src   string
+	pos   int
+	known map[string]bool
+}
+
+//compileExpression parses formula like "kekIndex * timeCoeff / groupActivity".
+//Only variables from known are allowed.
+func compileExpression(formula string, known []string) (expression, error) {
+	p := exprParser{
+		src:   formula,
+		known: map[string]bool{},
+	}
+	for _, name := range known {
+		p.known[name] = true
+	}
+
+	expr, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos != len(p.src) {
+		return nil, fmt.Errorf("Unexpected symbol %q at position %d", p.src[p.pos], p.pos)
+	}
+	return expr, nil
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *exprParser) parseSum() (expression, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == '+' {
+			left = func(v map[string]float64) float64 { return l(v) + right(v) }
+		} else {
+			left = func(v map[string]float64) float64 { return l(v) - right(v) }
+		}
+	}
+}
+
+func (p *exprParser) parseProduct() (expression, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == '*' {
+			left = func(v map[string]float64) float64 { return l(v) * right(v) }
+		} else {
+			left = func(v map[string]float64) float64 { return l(v) / right(v) }
+		}
+	}
+}
+
+func (p *exprParser) parseUnary() (expression, error) {
+	if p.peek() == '-' {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v map[string]float64) float64 { return -operand(v) }, nil
+	}
+	return p.parsePower()
+}
+
+func (p *exprParser) parsePower() (expression, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != '^' {
+		return base, nil
+	}
+	p.pos++
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return func(v map[string]float64) float64 { return math.Pow(base(v), exponent(v)) }, nil
+}
+
+func (p *exprParser) parsePrimary() (expression, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("Unexpected end of formula")
+	case c == '(':
+		p.pos++
+		expr, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("Expected ')' at position %d", p.pos)
+		}
+		p.pos++
+		return expr, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+			p.pos++
+		}
+		value, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse number %s. Reason %s", p.src[start:p.pos], err)
+		}
+		return func(map[string]float64) float64 { return value }, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.peek() == '(' {
+			return p.parseCall(name)
+		}
+		if !p.known[name] {
+			return nil, fmt.Errorf("Unknown variable %s", name)
+		}
+		return func(v map[string]float64) float64 { return v[name] }, nil
+	default:
+		return nil, fmt.Errorf("Unexpected symbol %q at position %d", c, p.pos)
+	}
+}
+
+func (p *exprParser) parseCall(name string) (expression, error) {
+	f, ok := exprFuncs[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown function %s", name)
+	}
+	p.pos++ // '('
+
+	args := []expression{}
+	if p.peek() != ')' {
+		for {
+			arg, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+	}
+	if p.peek() != ')' {
+		return nil, fmt.Errorf("Expected ')' at position %d", p.pos)
+	}
+	p.pos++
+
+	if len(args) != f.args {
+		return nil, fmt.Errorf("Function %s expects %d arguments, got %d", name, f.args, len(args))
+	}
+
+	return func(v map[string]float64) float64 {
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			values[i] = arg(v)
+		}
+		return f.fn(values)
+	}, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+const DefaultLocale = "ru"
+
+//I18nConfig is [i18n] section. Chats override locale and caption template for chat id.
+type I18nConfig struct {
+	Locale    string
+	ParseMode string
+	Chats     map[string]ChatI18nConfig
+
+	//templates are compiled caption templates of catalog and chats
+	templates map[string]*template.Template
+}
+
+//ChatI18nConfig is settings of one chat. ParseMode is HTML, MarkdownV2 or "plain".
+type ChatI18nConfig struct {
+	Locale    string
+	Caption   string
+	ParseMode string
+}
+
+//messages is catalog of texts. Messages with numbers have form for every plural category of locale.
+var messages = map[string]map[string][]string{
+	"ru": {
+		"caption":          {"{{with .Description}}{{.}}\n\n{{end}}Новый мем от {{link .Public .Link}} с индексом кекабельности {{.Score}}"},
+		"personal_caption": {"{{with .Description}}{{.}}\n\n{{end}}Мем для тебя от {{link .Public .Link}} с индексом кекабельности {{.Score}}"},
+		"just_now":         {"только что"},
+		"minutes_ago":      {"%d минуту назад", "%d минуты назад", "%d минут назад"},
+		"hours_ago":        {"%d час назад", "%d часа назад", "%d часов назад"},
+		"today_at":         {"сегодня в %s"},
+		"yesterday_at":     {"вчера в %s"},
+		"callback_error":   {"Не получилось, попробуй еще раз"},
+	},
+	"en": {
+		"caption":          {"{{with .Description}}{{.}}\n\n{{end}}New meme from {{link .Public .Link}} with kek index {{.Score}}"},
+		"personal_caption": {"{{with .Description}}{{.}}\n\n{{end}}Meme for you from {{link .Public .Link}} with kek index {{.Score}}"},
+		"just_now":         {"just now"},
+		"minutes_ago":      {"%d minute ago", "%d minutes ago"},
+		"hours_ago":        {"%d hour ago", "%d hours ago"},
+		"today_at":         {"today at %s"},
+		"yesterday_at":     {"yesterday at %s"},
+		"callback_error":   {"Something went wrong, try again"},
+	},
+}
+
+//pluralRules return index of plural form for number
+var pluralRules = map[string]func(n int) int{
+	"ru": func(n int) int {
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return 0
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return 1
+		default:
+			return 2
+		}
+	},
+	"en": func(n int) int {
+		if n == 1 {
+			return 0
+		}
+		return 1
+	},
+}
+
+func message(locale, key string) []string {
+	if forms, ok := messages[locale][key]; ok {
+		return forms
+	}
+	if forms, ok := messages[DefaultLocale][key]; ok {
+		return forms
+	}
+	return []string{key}
+}
+
+//tr returns message of locale formatted with args
+func tr(locale, key string, args ...interface{}) string {
+	return fmt.Sprintf(message(locale, key)[0], args...)
+}
+
+//trn returns plural form of message for n
+func trn(locale, key string, n int) string {
+	forms := message(locale, key)
+	rule, ok := pluralRules[locale]
+	if !ok {
+		rule = pluralRules[DefaultLocale]
+	}
+	form := rule(n)
+	if form >= len(forms) {
+		form = len(forms) - 1
+	}
+	return fmt.Sprintf(forms[form], n)
+}
+
+//chatLocale returns locale configured for chat
+func (c *I18nConfig) chatLocale(chatId int64) string {
+	if chat, ok := c.Chats[strconv.FormatInt(chatId, 10)]; ok && chat.Locale != "" {
+		return chat.Locale
+	}
+	if c.Locale != "" {
+		return c.Locale
+	}
+	return DefaultLocale
+}
+
+//init checks locales and compiles caption templates of catalog and chats
+func (c *I18nConfig) init() error {
+	c.templates = map[string]*template.Template{}
+	if !isParseMode(c.ParseMode) {
+		return fmt.Errorf("Unknown parse mode %s", c.ParseMode)
+	}
+	if c.Locale != "" {
+		if _, ok := messages[c.Locale]; !ok {
+			return fmt.Errorf("Unknown locale %s", c.Locale)
+		}
+	}
+
+	for locale, catalog := range messages {
+		for _, key := range []string{"caption", "personal_caption"} {
+			tmpl, err := newCaptionTemplate(key, catalog[key][0])
+			if err != nil {
+				return fmt.Errorf("Cannot parse %s of locale %s. Reason %s", key, locale, err)
+			}
+			c.templates[locale+"/"+key] = tmpl
+		}
+	}
+
+	for chat, cfg := range c.Chats {
+		if _, err := strconv.ParseInt(chat, 10, 64); err != nil {
+			return fmt.Errorf("Wrong chat id %s in i18n.chats. Reason %s", chat, err)
+		}
+		if cfg.Locale != "" {
+			if _, ok := messages[cfg.Locale]; !ok {
+				return fmt.Errorf("Unknown locale %s for chat %s", cfg.Locale, chat)
+			}
+		}
+		if !isParseMode(cfg.ParseMode) {
+			return fmt.Errorf("Unknown parse mode %s for chat %s", cfg.ParseMode, chat)
+		}
+		if cfg.Caption == "" {
+			continue
+		}
+		tmpl, err := newCaptionTemplate(chat, cfg.Caption)
+		if err != nil {
+			return fmt.Errorf("Cannot parse caption of chat %s. Reason %s", chat, err)
+		}
+		//chat template replaces only channel caption, personal caption stays from catalog
+		c.templates[chat+"/caption"] = tmpl
+	}
+	return nil
+}
+
+//HumanTime describes time relative to now in locale
+func HumanTime(t time.Time, locale string) string {
+	return humanTime(t, time.Now(), locale)
+}
+
+func humanTime(t, now time.Time, locale string) string {
+	passed := now.Sub(t)
+	switch {
+	case passed < -5*time.Minute:
+		//time in future is not expected, small difference is clock skew
+		return t.Format("2006-01-02 15:04")
+	case passed < 5*time.Minute:
+		return tr(locale, "just_now")
+	case passed < time.Hour:
+		return trn(locale, "minutes_ago", int(passed/time.Minute))
+	case passed < 7*time.Hour:
+		return trn(locale, "hours_ago", int(passed/time.Hour))
+	}
+
+	sameDay := func(a, b time.Time) bool {
+		return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+	}
+	switch {
+	case sameDay(t, now):
+		return tr(locale, "today_at", t.Format("15:04"))
+	case sameDay(t, now.AddDate(0, 0, -1)):
+		return tr(locale, "yesterday_at", t.Format("15:04"))
+	}
+	return t.Format("2006-01-02 15:04")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHumanTime(t *testing.T) {
+	now := time.Date(2018, 5, 10, 20, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		passed time.Duration
+		locale string
+		want   string
+	}{
+		{"ru just now", 0, "ru", "только что"},
+		{"ru just now boundary", 5*time.Minute - time.Second, "ru", "только что"},
+		{"ru clock skew", -time.Minute, "ru", "только что"},
+		{"ru future", -2 * time.Hour, "ru", "2018-05-10 22:30"},
+		{"ru 5 minutes", 5 * time.Minute, "ru", "5 минут назад"},
+		{"ru 21 minute", 21 * time.Minute, "ru", "21 минуту назад"},
+		{"ru 22 minutes", 22 * time.Minute, "ru", "22 минуты назад"},
+		{"ru 59 minutes", time.Hour - time.Second, "ru", "59 минут назад"},
+		{"ru 1 hour", time.Hour, "ru", "1 час назад"},
+		{"ru 2 hours", 2 * time.Hour, "ru", "2 часа назад"},
+		{"ru 6 hours", 7*time.Hour - time.Second, "ru", "6 часов назад"},
+		{"ru today", 7 * time.Hour, "ru", "сегодня в 13:30"},
+		{"ru today midnight", 20*time.Hour + 30*time.Minute, "ru", "сегодня в 00:00"},
+		{"ru yesterday", 20*time.Hour + 31*time.Minute, "ru", "вчера в 23:59"},
+		{"ru yesterday midnight", 44*time.Hour + 30*time.Minute, "ru", "вчера в 00:00"},
+		{"ru days", 44*time.Hour + 31*time.Minute, "ru", "2018-05-08 23:59"},
+		{"en just now", 4 * time.Minute, "en", "just now"},
+		{"en future", -6 * time.Minute, "en", "2018-05-10 20:36"},
+		{"en 5 minutes", 5*time.Minute + 59*time.Second, "en", "5 minutes ago"},
+		{"en 1 hour", time.Hour + 59*time.Minute, "en", "1 hour ago"},
+		{"en 3 hours", 3 * time.Hour, "en", "3 hours ago"},
+		{"en today", 8 * time.Hour, "en", "today at 12:30"},
+		{"en yesterday", 22 * time.Hour, "en", "yesterday at 22:30"},
+		{"en days", 10 * 24 * time.Hour, "en", "2018-04-30 20:30"},
+	}
+	for _, tt := range tests {
+		got := humanTime(now.Add(-tt.passed), now, tt.locale)
+		if got != tt.want {
+			t.Errorf("%s: humanTime(now - %s) = %q, want %q", tt.name, tt.passed, got, tt.want)
+		}
+	}
+}
+
+func TestCaptionCountsVisibleText(t *testing.T) {
+	a, _ := newTestApp(t)
+	cfg := *a.Config()
+	cfg.I18n.Chats = map[string]ChatI18nConfig{
+		"1": {ParseMode: ParseModeHTML},
+		"2": {ParseMode: ParseModeMarkdownV2},
+		"3": {ParseMode: ParseModeHTML, Caption: strings.Repeat("long template ", 15) + "{{link .Public .Link}}"},
+	}
+	err := cfg.I18n.init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.config.Store(&cfg)
+
+	m := &Meme{
+		Platform:    "reddit",
+		Public:      "memes",
+		Link:        "https://example.com/" + strings.Repeat("a", 300),
+		Description: strings.Repeat("meme. ", 20),
+		Time:        time.Now(),
+	}
+	for _, chatId := range []int64{1, 2} {
+		caption, err := a.Caption(chatId, "caption", m, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		visible := visibleText(caption.ParseMode, caption.Text)
+		if n := len([]rune(visible)); n > MEDIA_CAPTION_SIZE {
+			t.Errorf("chat %d: visible caption has %d runes: %q", chatId, n, visible)
+		}
+		if !strings.HasPrefix(visible, m.Description) {
+			t.Errorf("chat %d: description is cut although it fits: %q", chatId, visible)
+		}
+		if !strings.Contains(caption.Text, strings.Repeat("a", 300)) {
+			t.Errorf("chat %d: caption has no link: %q", chatId, caption.Text)
+		}
+	}
+
+	caption, err := a.Caption(3, "caption", m, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caption.ParseMode != "" || strings.Contains(caption.Text, "<a") || len([]rune(caption.Text)) > MEDIA_CAPTION_SIZE {
+		t.Errorf("too long template is not rendered as plain text: %q in mode %q", caption.Text, caption.ParseMode)
+	}
+}
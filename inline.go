@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"gitlab.com/toby3d/telegram"
+)
+
+const (
+	//inlineResults is maximum results in one answer allowed by telegram
+	inlineResults = 50
+	//inlineCandidates is how many matches are ranked by score
+	inlineCandidates = 500
+)
+
+//inlineResult converts meme to photo result. Videos are not returned.
+func (a *App) inlineResult(m *Meme) interface{} {
+	picture := m.Pictures[0]
+	id := strconv.Itoa(m.Id)
+	caption := truncate(m.Description, MEDIA_CAPTION_SIZE)
+	if m.Platform == PlatformSubmission {
+		if isVideo(picture) {
+			return nil
+		}
+		res := telegram.NewInlineQueryResultCachedPhoto(id, picture)
+		res.Caption = caption
+		return res
+	}
+	res := telegram.NewInlineQueryResultPhoto(id, picture, picture)
+	res.Caption = caption
+	res.Description = a.publicName(m)
+	return res
+}
+
+//handleInlineQuery answers @bot query with memes ranked by KekScore. Offset is number of skipped results.
+func (a *App) handleInlineQuery(query *telegram.InlineQuery) {
+	offset, _ := strconv.Atoi(query.Offset)
+
+	memes, err := a.Storage.SearchMemes(query.Query, inlineCandidates)
+	if err != nil {
+		a.Log.Errorf("Cannot search memes for inline query %q. Reason %s", query.Query, err)
+	}
+
+	scorer := a.getScorer(a.Bot.ChatId)
+	coeffs := a.Storage.Coeffs()
+	now := time.Now()
+	scored := []ScoredMeme{}
+	for _, meme := range memes {
+		if len(meme.Pictures) == 0 {
+			continue
+		}
+		scored = append(scored, ScoredMeme{
+			Meme:  meme,
+			Score: finite(scorer.Score(&meme, coeffs, now)),
+		})
+	}
+	sort.SliceStable(scored, func(i, j int) bool { return scored[i].Score > scored[j].Score })
+
+	results := []interface{}{}
+	next := ""
+	for i := offset; i < len(scored); i++ {
+		if len(results) == inlineResults {
+			next = strconv.Itoa(i)
+			break
+		}
+		res := a.inlineResult(&scored[i].Meme)
+		if res != nil {
+			results = append(results, res)
+		}
+	}
+
+	_, err = a.Bot.bot.AnswerInlineQuery(&telegram.AnswerInlineQueryParameters{
+		InlineQueryID: query.ID,
+		Results:       results,
+		NextOffset:    next,
+	})
+	if err != nil {
+		a.Log.Errorf("Cannot answer inline query %q. Reason %s", query.Query, err)
+	}
+}
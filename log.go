@@ -2,32 +2,394 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/rossmcdonald/telegram_hook"
 
 	log "github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
 )
 
-//Log is logger for all programm
-var Log *log.Logger
+//LogConfig is [log] section. Type is stdout, file or syslog, Severity is minimal level.
+type LogConfig struct {
+	Type          string
+	Format        string
+	Severity      string
+	DebugMode     bool
+	FilePath      string
+	FileName      string
+	MaxSize       int
+	MaxBackups    int
+	NetworkType   string
+	Host          string
+	Port          string
+	Facility      string
+	TelegramLimit int
+}
+
+//severities maps syslog severities and logrus level names to levels
+var severities = map[string]log.Level{
+	"LOG_EMERG":   log.PanicLevel,
+	"LOG_ALERT":   log.PanicLevel,
+	"LOG_CRIT":    log.FatalLevel,
+	"LOG_ERR":     log.ErrorLevel,
+	"LOG_WARNING": log.WarnLevel,
+	"LOG_NOTICE":  log.InfoLevel,
+	"LOG_INFO":    log.InfoLevel,
+	"LOG_DEBUG":   log.DebugLevel,
+	"panic":       log.PanicLevel,
+	"fatal":       log.FatalLevel,
+	"error":       log.ErrorLevel,
+	"warning":     log.WarnLevel,
+	"warn":        log.WarnLevel,
+	"info":        log.InfoLevel,
+	"debug":       log.DebugLevel,
+}
+
+var facilities = map[string]syslog.Priority{
+	"LOG_KERN":     syslog.LOG_KERN,
+	"LOG_USER":     syslog.LOG_USER,
+	"LOG_MAIL":     syslog.LOG_MAIL,
+	"LOG_DAEMON":   syslog.LOG_DAEMON,
+	"LOG_AUTH":     syslog.LOG_AUTH,
+	"LOG_SYSLOG":   syslog.LOG_SYSLOG,
+	"LOG_LPR":      syslog.LOG_LPR,
+	"LOG_NEWS":     syslog.LOG_NEWS,
+	"LOG_UUCP":     syslog.LOG_UUCP,
+	"LOG_CRON":     syslog.LOG_CRON,
+	"LOG_AUTHPRIV": syslog.LOG_AUTHPRIV,
+	"LOG_FTP":      syslog.LOG_FTP,
+	"LOG_LOCAL0":   syslog.LOG_LOCAL0,
+	"LOG_LOCAL1":   syslog.LOG_LOCAL1,
+	"LOG_LOCAL2":   syslog.LOG_LOCAL2,
+	"LOG_LOCAL3":   syslog.LOG_LOCAL3,
+	"LOG_LOCAL4":   syslog.LOG_LOCAL4,
+	"LOG_LOCAL5":   syslog.LOG_LOCAL5,
+	"LOG_LOCAL6":   syslog.LOG_LOCAL6,
+	"LOG_LOCAL7":   syslog.LOG_LOCAL7,
+}
+
+func (c *LogConfig) level() (log.Level, error) {
+	if c.DebugMode {
+		return log.DebugLevel, nil
+	}
+	if c.Severity == "" {
+		return log.InfoLevel, nil
+	}
+	level, ok := severities[c.Severity]
+	if !ok {
+		return 0, fmt.Errorf("Unknown log severity %s", c.Severity)
+	}
+	return level, nil
+}
+
+func (c *LogConfig) facility() (syslog.Priority, error) {
+	if c.Facility == "" {
+		return syslog.LOG_USER, nil
+	}
+	facility, ok := facilities[c.Facility]
+	if !ok {
+		return 0, fmt.Errorf("Unknown syslog facility %s", c.Facility)
+	}
+	return facility, nil
+}
+
+func (c *LogConfig) formatter() (log.Formatter, error) {
+	switch c.Format {
+	case "", "text":
+		return &log.TextFormatter{FullTimestamp: true}, nil
+	case "json":
+		return &log.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown log format %s", c.Format)
+	}
+}
+
+func (c *LogConfig) path() string {
+	name := c.FileName
+	if name == "" {
+		name = "fedormemes.log"
+	}
+	return filepath.Join(c.FilePath, name)
+}
+
+//maxSize is size of log file in bytes after which it is rotated
+func (c *LogConfig) maxSize() int64 {
+	if c.MaxSize <= 0 {
+		return 100 << 20
+	}
+	return int64(c.MaxSize) << 20
+}
+
+func (c *LogConfig) maxBackups() int {
+	if c.MaxBackups <= 0 {
+		return 5
+	}
+	return c.MaxBackups
+}
+
+//telegramLimit is how many errors per minute are sent to debug chat
+func (c *LogConfig) telegramLimit() int {
+	if c.TelegramLimit == 0 {
+		return 10
+	}
+	return c.TelegramLimit
+}
+
+//validate checks values without opening files and connections
+func (c *LogConfig) validate() error {
+	switch c.Type {
+	case "", "stdout", "file", "syslog":
+	default:
+		return fmt.Errorf("Unknown log type %s", c.Type)
+	}
+	if _, err := c.level(); err != nil {
+		return err
+	}
+	if _, err := c.facility(); err != nil {
+		return err
+	}
+	_, err := c.formatter()
+	return err
+}
+
+//initLogger creates logger writing to stdout, rotated file or syslog as configured in [log] section
+func initLogger(cfg *TomlConfig) (*log.Logger, error) {
+	c := &cfg.Log
+	logger := log.New()
+
+	var err error
+	logger.Level, err = c.level()
+	if err != nil {
+		return nil, err
+	}
+	logger.Formatter, err = c.formatter()
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Type {
+	case "", "stdout":
+		logger.Out = os.Stdout
+	case "file":
+		logger.Out, err = openRotatingFile(c.path(), c.maxSize(), c.maxBackups())
+		if err != nil {
+			return nil, err
+		}
+	case "syslog":
+		hook, err := initSyslogger(c, cfg.Title)
+		if err != nil {
+			return nil, err
+		}
+		logger.Hooks.Add(hook)
+		logger.Out = ioutil.Discard
+	default:
+		return nil, fmt.Errorf("Unknown log type %s", c.Type)
+	}
+
+	return logger, nil
+}
+
+//initSyslogger connects to local syslog or to host:port if host is set
+func initSyslogger(c *LogConfig, tag string) (log.Hook, error) {
+	facility, err := c.facility()
+	if err != nil {
+		return nil, err
+	}
+	addr := ""
+	if c.Host != "" {
+		addr = fmt.Sprintf("%s:%s", c.Host, c.Port)
+	}
+	hook, err := lsyslog.NewSyslogHook(c.NetworkType, addr, facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to syslog. Reason %s", err)
+	}
+	return hook, nil
+}
+
+//rotatingFile is log file which is renamed to name.1 when it grows over maxSize,
+//older copies are shifted up to name.<maxBackups>
+type rotatingFile struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Cannot open log file %s. Reason %s", f.path, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Cannot get stat of log file %s. Reason %s", f.path, err)
+	}
+	f.file = file
+	f.size = stat.Size()
+	return nil
+}
+
+//rotate reopens file even if renaming fails, so logging goes on
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	renameErr := os.Rename(f.path, f.path+".1")
+	err := f.open()
+	if err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("Cannot rotate log file %s. Reason %s", f.path, renameErr)
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		err := f.rotate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+//logFlushTimeout is how long queued errors are sent to debug chat on shutdown and fatal
+const logFlushTimeout = 10 * time.Second
+
+//telegramSink sends errors to debug chat in background. Entries over limit per minute
+//or while queue is full are dropped, their count is sent with next message.
+type telegramSink struct {
+	hook    *telegram_hook.TelegramHook
+	entries chan *log.Entry
+	limit   int
+	//pending counts entries in queue and in sending
+	pending sync.WaitGroup
+
+	sync.Mutex
+	dropped int
+}
+
+func (s *telegramSink) Levels() []log.Level {
+	return []log.Level{log.ErrorLevel, log.FatalLevel, log.PanicLevel}
+}
+
+func (s *telegramSink) Fire(entry *log.Entry) error {
+	//entry is reused by logger after hooks, so it is copied
+	data := make(log.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	e := &log.Entry{Logger: entry.Logger, Data: data, Time: entry.Time, Level: entry.Level, Message: entry.Message}
+
+	s.pending.Add(1)
+	select {
+	case s.entries <- e:
+	default:
+		s.pending.Done()
+		s.drop()
+	}
+	return nil
+}
+
+//flush waits until queued entries are sent or timeout passes
+func (s *telegramSink) flush(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		fmt.Fprintf(os.Stderr, "Cannot send all logs to telegram in %s\n", timeout)
+	}
+}
+
+func (s *telegramSink) drop() {
+	s.Lock()
+	s.dropped++
+	s.Unlock()
+}
+
+func (s *telegramSink) run() {
+	window := time.Now()
+	sent := 0
+	for e := range s.entries {
+		if time.Since(window) >= time.Minute {
+			window = time.Now()
+			sent = 0
+		}
+		if sent >= s.limit {
+			s.drop()
+			s.pending.Done()
+			continue
+		}
+		sent++
+
+		s.Lock()
+		if s.dropped > 0 {
+			e.Data["dropped"] = s.dropped
+			s.dropped = 0
+		}
+		s.Unlock()
+		err := s.hook.Fire(e)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot send log to telegram. Reason %s\n", err)
+		}
+		s.pending.Done()
+	}
+}
+
+//addTelegramHook sends errors to debug chat. Token is checked by request to Bot API, so it is done only online.
+//Returned sink is nil if hook is disabled. Fatal flushes sink before exit.
+func addTelegramHook(logger *log.Logger, cfg *TomlConfig) (*telegramSink, error) {
+	if cfg.TelegramBot.Token == "" || cfg.Log.telegramLimit() < 0 {
+		return nil, nil
+	}
 
-//initLogger take from Config parameters for logger and init logger.
-//If we use syslog, we will call initSyslogger.
-func initLogger() (*log.Logger, error) {
 	hook, err := telegram_hook.NewTelegramHook(
-		Config.Title,
-		Config.TelegramBot.Token,
-		fmt.Sprintf("%d", Config.TelegramBot.ChatIdDebug),
+		cfg.Title,
+		cfg.TelegramBot.Token,
+		fmt.Sprintf("%d", cfg.TelegramBot.ChatIdDebug),
 		telegram_hook.WithAsync(false),
 		telegram_hook.WithTimeout(5*time.Second),
 	)
 	if err != nil {
-		log.Fatalf("Encountered error when creating Telegram hook: %s", err)
+		return nil, fmt.Errorf("Cannot create telegram hook for logger. Reason %s", err)
 	}
+	sink := &telegramSink{
+		hook:    hook,
+		entries: make(chan *log.Entry, 100),
+		limit:   cfg.Log.telegramLimit(),
+	}
+	go sink.run()
+	logger.Hooks.Add(sink)
+	log.RegisterExitHandler(func() { sink.flush(logFlushTimeout) })
 
-	logger := log.New()
-	logger.Hooks.Add(hook)
-
-	return logger, nil
+	return sink, nil
 }
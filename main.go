@@ -2,15 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -23,81 +26,20 @@ var (
 	Version, BuildTime string
 )
 
-func init() {
-	var versReq bool
-	var configPath string
-	flag.StringVar(&configPath, "c", "config.toml", "Used for set path to config file.")
-	flag.BoolVar(&versReq, "v", false, "Use for build time and version print")
-	var err error
-	flag.Parse()
-	if versReq {
-		fmt.Println("Version: ", Version)
-		fmt.Println("Build time:", BuildTime)
-		os.Exit(0)
-	}
-	Config, err = getConfig(configPath)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	Log, err = initLogger()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	err = Config.Reddit.Init()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	err = Config.TelegramBot.Connect()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	storage, err = NewStorage(Config.DB.Name)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	err = storage.Init()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	err = Config.VK.Init()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	err = Config.Telegram.Init()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-}
-
-func updateMemes(wr http.ResponseWriter, req *http.Request) {
-	Config.VK.update()
-	Config.Reddit.update()
-	Config.Telegram.update()
-	err := storage.Dump()
-	if err != nil {
-		Log.Errorf("Cannot dump memes. Reason %s", err)
+//updateMemes fetches memes in request. Fetch is registered in tracker, so storage is not closed under it.
+func (a *App) updateMemes(wr http.ResponseWriter, req *http.Request) {
+	if !a.tasks.start() {
+		http.Error(wr, "Server is shutting down", http.StatusServiceUnavailable)
+		return
 	}
+	defer a.tasks.done()
+	a.update(a.ctx)
 }
 
-func downloadFile(wr http.ResponseWriter, req *http.Request, f *os.File) {
+func (a *App) downloadFile(wr http.ResponseWriter, req *http.Request, f *os.File) {
 	stat, err := f.Stat()
 	if err != nil {
-		Log.Errorf("Cannot get stat for dump.csv. Reason %s", err)
+		a.Log.Errorf("Cannot get stat for dump.csv. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -109,33 +51,33 @@ func downloadFile(wr http.ResponseWriter, req *http.Request, f *os.File) {
 
 	_, err = io.Copy(wr, f)
 	if err != nil {
-		Log.Errorf("Cannot copy dump.csv. Reason %s", err)
+		a.Log.Errorf("Cannot copy dump.csv. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
-func downloadDump(wr http.ResponseWriter, req *http.Request) {
+func (a *App) downloadDump(wr http.ResponseWriter, req *http.Request) {
 	f, err := os.Open("./dump.csv")
 	if err != nil {
-		Log.Errorf("Cannot read memes dump. Reason %s", err)
+		a.Log.Errorf("Cannot read memes dump. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	downloadFile(wr, req, f)
+	a.downloadFile(wr, req, f)
 }
 
-func downloadStats(wr http.ResponseWriter, req *http.Request) {
-	stats, err := storage.getStatistics(Config.TelegramBot.ChatId)
+func (a *App) downloadStats(wr http.ResponseWriter, req *http.Request) {
+	stats, err := a.Storage.getStatistics(a.Config().TelegramBot.ChatId)
 	if err != nil {
-		Log.Errorf("Cannot get statistic. Reason %s", err)
+		a.Log.Errorf("Cannot get statistic. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	csvContent, err := gocsv.MarshalString(&stats)
 	if err != nil {
-		Log.Errorf("Cannot marshal to csv. Reason %s", err)
+		a.Log.Errorf("Cannot marshal to csv. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -149,40 +91,83 @@ func downloadStats(wr http.ResponseWriter, req *http.Request) {
 
 	_, err = io.Copy(wr, r)
 	if err != nil {
-		Log.Errorf("Cannot copy stats.csv. Reason %s", err)
+		a.Log.Errorf("Cannot copy stats.csv. Reason %s", err)
+		wr.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a *App) downloadExperiment(wr http.ResponseWriter, req *http.Request) {
+	arms, err := a.Storage.getExperimentReport(a.Config().TelegramBot.ChatId)
+	if err != nil {
+		a.Log.Errorf("Cannot get experiment report. Reason %s", err)
+		wr.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	csvContent, err := gocsv.MarshalString(&arms)
+	if err != nil {
+		a.Log.Errorf("Cannot marshal to csv. Reason %s", err)
+		wr.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	r := strings.NewReader(csvContent)
+
+	wr.Header().Set("Content-Disposition", "attachment; filename=experiment.csv")
+	wr.Header().Set("Content-Type", "text/csv")
+	wr.Header().Set("Cache-Control", "no-cache")
+	wr.Header().Set("Content-Length", fmt.Sprintf("%d", r.Size()))
+
+	_, err = io.Copy(wr, r)
+	if err != nil {
+		a.Log.Errorf("Cannot copy experiment.csv. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
-func downloadRatings(wr http.ResponseWriter, req *http.Request) {
+func (a *App) downloadRatings(wr http.ResponseWriter, req *http.Request) {
 	var err error
 	id := chi.URLParam(req, "id")
 	data := [][]string{}
+	coeffs := a.Storage.Coeffs()
 
 	switch id {
 	case "groupRatings":
-		data = append(data, []string{"platform", "group", "rating"})
-		for platform := range storage.GroupRatings {
-			for group, rating := range storage.GroupRatings[platform] {
-				data = append(data, []string{platform, group, fmt.Sprintf("%f", rating)})
+		data = append(data, []string{"platform", "group", "rating", "lower", "upper", "likes", "dislikes"})
+		for platform := range coeffs.GroupRatings {
+			for group, rating := range coeffs.GroupRatings[platform] {
+				data = append(data, []string{platform, group,
+					fmt.Sprintf("%f", rating.Value),
+					fmt.Sprintf("%f", rating.Lower),
+					fmt.Sprintf("%f", rating.Upper),
+					fmt.Sprintf("%f", rating.Likes),
+					fmt.Sprintf("%f", rating.Dislikes),
+				})
 			}
 		}
 	case "groupActivity":
 		data = append(data, []string{"platform", "group", "activity"})
-		for platform := range storage.GroupActivity {
-			for group, activity := range storage.GroupActivity[platform] {
+		for platform := range coeffs.GroupActivity {
+			for group, activity := range coeffs.GroupActivity[platform] {
 				data = append(data, []string{platform, group, fmt.Sprintf("%f", activity)})
 			}
 		}
 	case "platformRatings":
-		data = append(data, []string{"platform", "rating"})
-		for platform, rating := range storage.PlatformRatings {
-			data = append(data, []string{platform, fmt.Sprintf("%f", rating)})
+		data = append(data, []string{"platform", "rating", "lower", "upper", "likes", "dislikes"})
+		for platform, rating := range coeffs.PlatformRatings {
+			data = append(data, []string{platform,
+				fmt.Sprintf("%f", rating.Value),
+				fmt.Sprintf("%f", rating.Lower),
+				fmt.Sprintf("%f", rating.Upper),
+				fmt.Sprintf("%f", rating.Likes),
+				fmt.Sprintf("%f", rating.Dislikes),
+			})
 		}
 	case "platformActivity":
 		data = append(data, []string{"platform", "rating"})
-		for platform, activity := range storage.PlatformActivity {
+		for platform, activity := range coeffs.PlatformActivity {
 			data = append(data, []string{platform, fmt.Sprintf("%f", activity)})
 		}
 	default:
@@ -194,12 +179,15 @@ func downloadRatings(wr http.ResponseWriter, req *http.Request) {
 
 	err = csv.NewWriter(buf).WriteAll(data)
 	if err != nil {
-		Log.Errorf("Cannot marshal to csv. Reason %s", err)
+		a.Log.Errorf("Cannot marshal to csv. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	wr.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", id))
+	if !coeffs.ComputedAt.IsZero() {
+		wr.Header().Set("Last-Modified", coeffs.ComputedAt.UTC().Format(http.TimeFormat))
+	}
 	wr.Header().Set("Content-Type", "text/csv")
 	wr.Header().Set("Cache-Control", "no-cache")
 	wr.Header().Set("Content-Description", "File Transfer")
@@ -207,104 +195,281 @@ func downloadRatings(wr http.ResponseWriter, req *http.Request) {
 
 	_, err = io.Copy(wr, buf)
 	if err != nil {
-		Log.Errorf("Cannot copy stats.csv. Reason %s", err)
+		a.Log.Errorf("Cannot copy stats.csv. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
-func topDaylyMemHandler(wr http.ResponseWriter, req *http.Request) {
-	memes, err := storage.GetUnshownMemes(Config.TelegramBot.ChatId, time.Now().Add(-time.Duration(24)*time.Hour))
+func (a *App) topDaylyMemHandler(wr http.ResponseWriter, req *http.Request) {
+	if dryRun, _ := strconv.ParseBool(req.FormValue("dry_run")); dryRun {
+		a.writePreview(wr)
+		return
+	}
+
+	_, err := a.postTopMeme()
+	if err == NoMemes || err == NoApprovedMemes {
+		a.Log.Infof("Nothing to post. %s", err)
+		http.Error(wr, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		Log.Errorf("Cannot get memes. Reason %s", err)
+		a.Log.Errorf("Cannot post top meme. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+}
 
-	if len(memes) == 0 {
-		Log.Errorf("No memes available")
+func (a *App) writePreview(wr http.ResponseWriter) {
+	previews, err := a.previewTopMeme()
+	if err == NoMemes || err == NoApprovedMemes {
+		http.Error(wr, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		a.Log.Errorf("Cannot preview top meme. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	Log.Infof("Available memes %v", memes)
 
-	topMem := memes[0]
-	for _, mem := range memes {
-		if mem.СalculateKekScore() > topMem.СalculateKekScore() {
-			topMem = mem
-		}
+	wr.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(wr).Encode(previews)
+	if err != nil {
+		a.Log.Errorf("Cannot encode preview. Reason %s", err)
 	}
+}
 
-	public := ""
-	switch strings.ToLower(topMem.Platform) {
-	case "vk":
-		public = Config.VK.Publics[topMem.Public].Name
-	case "reddit":
-		public = fmt.Sprintf("/r/%s", topMem.Public)
+func (a *App) getQueue(wr http.ResponseWriter, req *http.Request) {
+	items, err := a.Storage.GetQueue(a.Config().TelegramBot.ChatId)
+	if err != nil {
+		a.Log.Errorf("Cannot get queue. Reason %s", err)
+		wr.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(wr).Encode(items)
+	if err != nil {
+		a.Log.Errorf("Cannot encode queue. Reason %s", err)
 	}
+}
 
-	Log.Infof("Top mem: %v", topMem)
+//slotTimeParam parses optional "at" parameter. Empty parameter means next slot.
+func slotTimeParam(req *http.Request) (time.Time, error) {
+	at := req.FormValue("at")
+	if at == "" {
+		return time.Time{}, nil
+	}
+	return parseSlotTime(at)
+}
 
-	msgid, err := Config.TelegramBot.SendPhoto(topMem.Pictures, topMem.Description,
-		fmt.Sprintf("Новый мем от %s с индексом кекабельности %.2f",
-			public,
-			topMem.СalculateKekScore(),
-		))
+func (a *App) enqueueMeme(wr http.ResponseWriter, req *http.Request) {
+	memeId, err := strconv.Atoi(chi.URLParam(req, "memeId"))
+	if err != nil {
+		http.Error(wr, "Wrong meme id", http.StatusBadRequest)
+		return
+	}
+	_, err = a.Storage.GetMemeById(memeId)
 	if err != nil {
-		Log.Errorf("Cannot send photo to telegram. Reason %s", err)
+		http.Error(wr, "Meme not found", http.StatusNotFound)
+		return
+	}
+	scheduled, err := slotTimeParam(req)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := a.Storage.Enqueue(a.Config().TelegramBot.ChatId, memeId, scheduled)
+	if err != nil {
+		a.Log.Errorf("Cannot enqueue meme. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	fmt.Fprintf(wr, "%d", id)
+}
+
+func (a *App) pinQueueItem(wr http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(wr, "Wrong queue item id", http.StatusBadRequest)
+		return
+	}
+	scheduled, err := slotTimeParam(req)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	err = storage.MarkMemeShown(Config.TelegramBot.ChatId, msgid, topMem.Id)
+	err = a.Storage.PinQueueItem(id, scheduled)
+	if err == NotFound {
+		http.Error(wr, "Queue item not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		Log.Errorf("Cannot mark meme shown. Reason %s", err)
+		a.Log.Errorf("Cannot pin queue item. Reason %s", err)
 		wr.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+}
 
-	memeStr, _ := json.MarshalIndent(MemeDebug{
-		Meme:          topMem,
-		KekIndex:      topMem.calculateKekIndex(),
-		TimePassed:    time.Now().Sub(topMem.Time).String(),
-		TimeCoeff:     topMem.calculateTimeCoeff(),
-		GroupCoeff:    topMem.calculateGroupRating(),
-		GroupActivity: topMem.calculateGroupActivity(),
-		KekScore:      topMem.СalculateKekScore(),
-	}, "", "  ")
+func (a *App) moveQueueItem(wr http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(wr, "Wrong queue item id", http.StatusBadRequest)
+		return
+	}
+	position, err := strconv.Atoi(chi.URLParam(req, "position"))
+	if err != nil {
+		http.Error(wr, "Wrong position", http.StatusBadRequest)
+		return
+	}
 
-	err = Config.TelegramBot.SendDebugText(fmt.Sprintf("Мем:\n%s", string(memeStr)))
+	err = a.Storage.MoveQueueItem(a.Config().TelegramBot.ChatId, id, position)
+	if err == NotFound {
+		http.Error(wr, "Queue item not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		Log.Errorf("Cannot send debug info. Reason %s", err)
+		a.Log.Errorf("Cannot move queue item. Reason %s", err)
+		wr.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+}
 
+func (a *App) cancelQueueItem(wr http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(wr, "Wrong queue item id", http.StatusBadRequest)
+		return
+	}
+
+	err = a.Storage.CancelQueueItem(id)
+	if err == NotFound {
+		http.Error(wr, "Queue item not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		a.Log.Errorf("Cannot cancel queue item. Reason %s", err)
+		wr.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
 
 func main() {
-	var err error
+	var versReq bool
+	var configPath string
+	flag.StringVar(&configPath, "c", "config.toml", "Used for set path to config file.")
+	flag.BoolVar(&versReq, "v", false, "Use for build time and version print")
+	flag.Usage = usage
+	flag.Parse()
+	if versReq {
+		fmt.Println("Version: ", Version)
+		fmt.Println("Build time:", BuildTime)
+		os.Exit(0)
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	name := flag.Arg(0)
+	args := flag.Args()
+	if name == "" {
+		name = "serve"
+	} else {
+		args = args[1:]
+	}
+	if name == "help" {
+		usage()
+		os.Exit(0)
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	cfg, err := getConfig(configPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	router := chi.NewRouter()
-	router.Post("/post", topDaylyMemHandler)
-	router.Post("/update/memes", updateMemes)
-	router.Get("/download/dump", downloadDump)
-	router.Get("/download/stats", downloadStats)
-	router.Get("/download/ratings/{id}", downloadRatings)
+	app, err := NewApp(context.Background(), cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	app.ConfigPath = configPath
+
+	if cmd.migrate {
+		err = app.initStorage()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 
-	err = http.ListenAndServe(Config.ServeAddress, router)
+	err = cmd.run(app, args)
 	if err != nil {
-		fmt.Println("ListenAndServe", err)
+		fmt.Println(err)
 		os.Exit(1)
 	}
+}
+
+//runServe runs bot, fetchers and http api until signal
+func runServe(app *App, args []string) error {
+	err := flag.NewFlagSet("serve", flag.ContinueOnError).Parse(args)
+	if err != nil {
+		return err
+	}
 
-	err = storage.DB.Close()
+	err = app.Start(app.ctx)
 	if err != nil {
-		Log.Errorf("Cannot close db. Reason %s", err)
+		return err
 	}
-	sgnl := make(chan os.Signal)
+
+	sgnl := make(chan os.Signal, 1)
 	signal.Notify(sgnl,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
-	_ = <-sgnl
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	server := &http.Server{Addr: app.Config().ServeAddress, Handler: app.router()}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			app.Log.Fatalf("Cannot listen on %s. Reason %s", server.Addr, err)
+		}
+	}()
+
+	var s os.Signal
+	for s == nil {
+		select {
+		case <-hup:
+			_, err := app.reloadConfig()
+			if err != nil {
+				app.Log.Errorf("Cannot reload config. Reason %s", err)
+			}
+		case s = <-sgnl:
+		}
+	}
+	app.Log.Infof("Got signal %s, shutting down", s)
+	app.stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		app.Log.Errorf("Cannot shutdown http server. Reason %s", err)
+	}
+	err = app.tasks.wait(ctx)
+	if err != nil {
+		app.Log.Errorf("%s", err)
+	}
+
+	err = app.Storage.Close()
+	app.flushLog()
+	return err
 }
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"math"
+	"strings"
 	"time"
 )
 
@@ -18,16 +20,38 @@ type Meme struct {
 	Views       int
 	Comments    int
 	Time        time.Time
+	Author      string
+	Link        string
 }
 
 type MemeDebug struct {
 	Meme
-	KekIndex      float64
-	TimePassed    string
-	TimeCoeff     float64
-	GroupCoeff    float64
-	GroupActivity float64
-	KekScore      float64
+	Scorer           string
+	Arm              string `json:",omitempty"`
+	KekIndex         float64
+	TimePassed       string
+	TimeCoeff        float64
+	GroupCoeff       float64
+	GroupActivity    float64
+	PlatformRating   float64
+	PlatformActivity float64
+	KekScore         float64
+}
+
+func NewMemeDebug(m Meme, scorer Scorer, c *Coeffs) MemeDebug {
+	now := time.Now()
+	return MemeDebug{
+		Meme:             m,
+		Scorer:           scorer.Name(),
+		KekIndex:         m.calculateKekIndex(),
+		TimePassed:       now.Sub(m.Time).String(),
+		TimeCoeff:        m.calculateTimeCoeff(c, now),
+		GroupCoeff:       m.calculateGroupRating(c),
+		GroupActivity:    m.calculateGroupActivity(c),
+		PlatformRating:   m.calculatePlatformRating(c),
+		PlatformActivity: m.calculatePlatformActivity(c),
+		KekScore:         scorer.Score(&m, c, now),
+	}
 }
 
 type Pictures []string
@@ -37,6 +61,41 @@ func (p *Pictures) MarshalCSV() (string, error) {
 	return string(data), err
 }
 
+//publicName is human readable name of meme source
+func (a *App) publicName(m *Meme) string {
+	switch strings.ToLower(m.Platform) {
+	case "vk":
+		return a.Config().VK.Publics[m.Public].Name
+	case "reddit":
+		return fmt.Sprintf("/r/%s", m.Public)
+	case PlatformSubmission:
+		name, err := a.Storage.getSubmitterName(m.Id)
+		if err != nil {
+			a.Log.Errorf("%s", err)
+		}
+		return name
+	}
+	return ""
+}
+
+//sourceLink is link to original post. Memes fetched before links were stored get link built from id if possible.
+func (a *App) sourceLink(m *Meme) string {
+	if m.Link != "" {
+		return m.Link
+	}
+	switch strings.ToLower(m.Platform) {
+	case "vk":
+		link, err := a.Config().VK.postLink(m.Public, m.MemeId)
+		if err != nil {
+			a.Log.Errorf("%s", err)
+		}
+		return link
+	case "reddit":
+		return fmt.Sprintf("https://redd.it/%s", strings.TrimPrefix(m.MemeId, "t3_"))
+	}
+	return ""
+}
+
 func (m *Meme) calculateKekIndex() float64 {
 	if m.Views == 0 {
 		return 0
@@ -44,71 +103,40 @@ func (m *Meme) calculateKekIndex() float64 {
 	return float64(m.Likes) / float64(m.Views) * float64(m.Reposts) / float64(m.Views) * 1000000
 }
 
-func (m *Meme) calculateTimeCoeff() float64 {
-	x := float64(time.Now().Sub(m.Time)) / float64(time.Hour)
+func (m *Meme) calculateTimeCoeff(c *Coeffs, at time.Time) float64 {
+	x := float64(at.Sub(m.Time)) / float64(time.Hour)
 
-	return 1 / math.Exp(x/Config.Metric.Coeff)
+	return 1 / math.Exp(x/c.TimeCoeff)
 }
 
-func (m *Meme) calculateGroupRating() float64 {
-	if _, ok := storage.GroupRatings[m.Platform]; !ok {
-		if def, ok := Config.Metric.DefaultGroupRating[m.Platform]; ok {
-			return def
-		}
-		return 1.0
-	}
-	groupRating, ok := storage.GroupRatings[m.Platform][m.Public]
+func (m *Meme) calculateGroupRating(c *Coeffs) float64 {
+	groupRating, ok := c.GroupRatings[m.Platform][m.Public]
 	if !ok {
-		if def, ok := Config.Metric.DefaultGroupRating[m.Platform]; ok {
-			return def
-		}
-		return 1.0
+		return c.Prior.Value
 	}
-	return groupRating
+	return groupRating.Value
 }
 
-func (m *Meme) calculateGroupActivity() float64 {
-	if _, ok := storage.GroupActivity[m.Platform]; !ok {
-		Log.Infof("calculateGroupActivity Cannot find %s in %v", m.Platform, storage.GroupActivity)
-		return 1.0
-	}
-	if _, ok := storage.GroupActivity[m.Platform][m.Public]; !ok {
-		Log.Infof("calculateGroupActivity Cannot find %s in %v", m.Platform, storage.GroupActivity)
+func (m *Meme) calculateGroupActivity(c *Coeffs) float64 {
+	activity, ok := c.GroupActivity[m.Platform][m.Public]
+	if !ok {
 		return 1.0
 	}
-	return storage.GroupActivity[m.Platform][m.Public]
+	return activity
 }
 
-func (m *Meme) calculatePlatformRating() float64 {
-	rating, ok := storage.PlatformRatings[m.Platform]
+func (m *Meme) calculatePlatformRating(c *Coeffs) float64 {
+	rating, ok := c.PlatformRatings[m.Platform]
 	if !ok {
-		if def, ok := Config.Metric.DefaultGroupRating[m.Platform]; ok {
-			return def
-		}
-		return 1.0
+		return c.Prior.Value
 	}
-	return rating
+	return rating.Value
 }
 
-func (m *Meme) calculatePlatformActivity() float64 {
-	rating, ok := storage.PlatformActivity[m.Platform]
+func (m *Meme) calculatePlatformActivity(c *Coeffs) float64 {
+	activity, ok := c.PlatformActivity[m.Platform]
 	if !ok {
-		Log.Infof("calculateGroupActivity Cannot find %s in %v", m.Platform, storage.GroupActivity)
 		return 1.0
 	}
-	return rating
-}
-
-func (m *Meme) СalculateKekScore() float64 {
-	if m.Views == 0 {
-		return 0
-	}
-	//var summedWeight = kekIndexWeight + timeCoeffWeight + groupCoeffWeight + groupActivityWeight
-
-	score := m.calculateKekIndex() * m.calculateTimeCoeff()
-	score = score / m.calculateGroupActivity() * m.calculateGroupRating()
-	score = score / m.calculatePlatformActivity() * m.calculatePlatformRating()
-
-	//score := (kekIndexWeight*m.calculateKekIndex() + timeCoeffWeight*m.calculateTimeCoeff() + groupCoeffWeight*m.calculateGroupRating() /*+ groupActivityWeight*m.calculateGroupActivity()*/) / summedWeight //group coeff is unclear for me, need reconsideration of this coeff
-	return score
+	return activity
 }
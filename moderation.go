@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/toby3d/telegram"
+)
+
+const (
+	ModerationPending  = "pending"
+	ModerationApproved = "approved"
+	ModerationRejected = "rejected"
+	ModerationSkipped  = "skipped"
+	ModerationPosted   = "posted"
+
+	moderationPrefix = "mod:"
+)
+
+var NoApprovedMemes = fmt.Errorf("No approved memes available, candidates are sent to moderators")
+
+//ModerationConfig is [moderation] section. AutoApprove is in minutes, 0 disables auto approve.
+type ModerationConfig struct {
+	Enabled     bool
+	ChatId      int64
+	Candidates  int
+	AutoApprove int
+}
+
+//chatId returns chat of moderators, debug chat is used if it is not set
+func (c *ModerationConfig) chatId(debugChatId int64) int64 {
+	if c.ChatId == 0 {
+		return debugChatId
+	}
+	return c.ChatId
+}
+
+func (c *ModerationConfig) candidates() int {
+	if c.Candidates <= 0 {
+		return 3
+	}
+	return c.Candidates
+}
+
+func (s *Storage) AddModerationCandidate(memeId int, chatId int64, msgId int) error {
+	_, err := s.DB.Exec("INSERT OR REPLACE INTO moderation (meme_id, chat_id, msg_id, state, created) VALUES (?, ?, ?, ?, ?)",
+		memeId, chatId, msgId, ModerationPending, time.Now().Format(ISO8601))
+	if err != nil {
+		return fmt.Errorf("Cannot add meme %d to moderation. Reason %s", memeId, err)
+	}
+	return nil
+}
+
+//SetModerationState saves decision. Posted memes cannot be changed.
+func (s *Storage) SetModerationState(memeId int, state string, userId int) error {
+	_, err := s.DB.Exec("UPDATE moderation SET state = ?, user_id = ?, decided = ? WHERE meme_id = ? and state != ?",
+		state, userId, time.Now().Format(ISO8601), memeId, ModerationPosted)
+	if err != nil {
+		return fmt.Errorf("Cannot set moderation state of meme %d. Reason %s", memeId, err)
+	}
+	return nil
+}
+
+func (s *Storage) getModeratedIds() (map[int]bool, error) {
+	res := map[int]bool{}
+	rows, err := s.DB.Query("SELECT meme_id FROM moderation")
+	if err != nil {
+		return res, fmt.Errorf("Cannot get moderated memes. Reason %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return res, fmt.Errorf("Cannot scan from row. Reason %s", err)
+		}
+		res[id] = true
+	}
+	return res, nil
+}
+
+//GetApprovedMemes returns approved memes not shown in chat which were sent to moderators after since.
+//Memes pending longer than autoApprove are approved too, except submitted ones which always need moderator's decision.
+func (s *Storage) GetApprovedMemes(chatId int64, since time.Time, autoApprove time.Duration) ([]Meme, error) {
+	//no creation time is less than empty string
+	autoApproved := ""
+	if autoApprove > 0 {
+		autoApproved = time.Now().Add(-autoApprove).Format(ISO8601)
+	}
+
+	rows, err := s.DB.Query(`select m.* from memes as m join moderation as md on md.meme_id == m.id
+where md.created > ? and (md.state == ? or (md.state == ? and md.created < ? and m.platform != ?)) and EXISTS(
+	select 1 from shown_memes as sm where m.id == sm.meme_id and sm.chat_id == ?
+) == 0 and EXISTS(
+	select 1 from banned_memes as bm where m.id == bm.meme_id
+) == 0`, since.Format(ISO8601), ModerationApproved, ModerationPending, autoApproved, PlatformSubmission, chatId)
+	if err != nil {
+		return []Meme{}, fmt.Errorf("Cannot get approved memes. Reason %s", err)
+	}
+	defer rows.Close()
+
+	return s.parseGetMemesAnswer(rows)
+}
+
+//getRejections returns rejected memes as stats with one dislike, they are negative signal for ratings
+func (s *Storage) getRejections() ([]MemeStat, error) {
+	res := []MemeStat{}
+	rows, err := s.DB.Query(`select m.platform, m.public, md.decided from moderation as md
+join memes as m on m.id == md.meme_id where md.state == ?`, ModerationRejected)
+	if err != nil {
+		return res, fmt.Errorf("Cannot get rejected memes. Reason %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			platform, public string
+			decided          sql.NullString
+		)
+		err = rows.Scan(&platform, &public, &decided)
+		if err != nil {
+			return res, fmt.Errorf("Cannot scan from row. Reason %s", err)
+		}
+		stat := MemeStat{
+			Platform: platform,
+			Public:   public,
+			Dislikes: 1,
+			Posted:   time.Now(),
+		}
+		if decided.Valid {
+			stat.Posted, err = time.Parse(ISO8601, decided.String)
+			if err != nil {
+				return res, fmt.Errorf("Cannot parse decision time. Reason %s", err)
+			}
+		}
+		res = append(res, stat)
+	}
+	return res, nil
+}
+
+//postModeratedMeme posts best approved meme and sends new candidates to moderators for next slots
+func (a *App) postModeratedMeme(scorer Scorer, arm string) (*Meme, error) {
+	memes, err := a.Storage.GetApprovedMemes(a.Config().TelegramBot.ChatId, time.Now().Add(-candidateWindow),
+		time.Duration(a.Config().Moderation.AutoApprove)*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	var posted *Meme
+	if len(memes) > 0 {
+		candidates := rankApproved(memes, scorer, a.Storage.Coeffs())
+		posted, _, err = a.postMeme(candidates[0], scorer, arm)
+		if err != nil {
+			return nil, err
+		}
+		err = a.Storage.SetModerationState(posted.Id, ModerationPosted, 0)
+		if err != nil {
+			a.Log.Errorf("Cannot mark moderated meme posted. Reason %s", err)
+		}
+		memes = memes[1:]
+	}
+
+	err = a.requestModeration(scorer, len(memes))
+	if err != nil {
+		a.Log.Errorf("Cannot request moderation. Reason %s", err)
+	}
+
+	if posted == nil {
+		return nil, NoApprovedMemes
+	}
+	return posted, nil
+}
+
+//rankApproved puts approved submissions first as they have no views to be scored by,
+//other memes are sorted by score
+func rankApproved(memes []Meme, scorer Scorer, coeffs *Coeffs) []ScoredMeme {
+	res := rankMemes(memes, scorer, coeffs)
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Platform == PlatformSubmission && res[j].Platform != PlatformSubmission
+	})
+	return res
+}
+
+func moderationKeyboard(memeId int) *telegram.InlineKeyboardMarkup {
+	return telegram.NewInlineKeyboardMarkup(telegram.NewInlineKeyboardRow(
+		telegram.NewInlineKeyboardButton("✅", fmt.Sprintf("%sapprove:%d", moderationPrefix, memeId)),
+		telegram.NewInlineKeyboardButton("❌", fmt.Sprintf("%sreject:%d", moderationPrefix, memeId)),
+		telegram.NewInlineKeyboardButton("⏭", fmt.Sprintf("%sskip:%d", moderationPrefix, memeId)),
+	))
+}
+
+//requestModeration sends top candidates to moderators chat until queue has enough memes
+func (a *App) requestModeration(scorer Scorer, queued int) error {
+	need := a.Config().Moderation.candidates() - queued
+	if need <= 0 {
+		return nil
+	}
+
+	moderated, err := a.Storage.getModeratedIds()
+	if err != nil {
+		return err
+	}
+
+	memes, err := a.selectTopMemes(a.Config().TelegramBot.ChatId, scorer, need+len(moderated))
+	if err != nil {
+		return err
+	}
+
+	for _, meme := range memes {
+		if need == 0 {
+			break
+		}
+		if moderated[meme.Id] {
+			continue
+		}
+
+		chatId := a.Config().Moderation.chatId(a.Config().TelegramBot.ChatIdDebug)
+		msgid, err := a.Bot.SendPhotoWithKeyboard(chatId, meme.Pictures, meme.Description,
+			fmt.Sprintf("#%d %s с индексом кекабельности %.2f", meme.Id, a.publicName(&meme.Meme), meme.Score),
+			moderationKeyboard(meme.Id))
+		if err != nil {
+			return fmt.Errorf("Cannot send meme %d to moderation. Reason %s", meme.Id, err)
+		}
+
+		err = a.Storage.AddModerationCandidate(meme.Id, chatId, msgid)
+		if err != nil {
+			return err
+		}
+		need--
+	}
+	return nil
+}
+
+func (a *App) handleModerationCallback(query *telegram.CallbackQuery) {
+	answer := func(text string) {
+		a.Bot.bot.AnswerCallbackQuery(&telegram.AnswerCallbackQueryParameters{
+			CallbackQueryID: query.ID,
+			Text:            text,
+		})
+	}
+
+	parts := strings.Split(strings.TrimPrefix(query.Data, moderationPrefix), ":")
+	if len(parts) != 2 {
+		a.Log.Errorf("Wrong moderation callback data %s", query.Data)
+		answer("")
+		return
+	}
+	memeId, err := strconv.Atoi(parts[1])
+	if err != nil {
+		a.Log.Errorf("Wrong meme id in moderation callback %s", query.Data)
+		answer("")
+		return
+	}
+
+	var state, text string
+	switch parts[0] {
+	case "approve":
+		state, text = ModerationApproved, "✅ одобрен"
+	case "reject":
+		state, text = ModerationRejected, "❌ отклонен"
+	case "skip":
+		state, text = ModerationSkipped, "⏭ пропущен"
+	default:
+		answer("Уже решено")
+		return
+	}
+
+	err = a.Storage.SetModerationState(memeId, state, query.From.ID)
+	if err != nil {
+		a.Log.Errorf("Cannot save moderation decision. Reason %s", err)
+		answer("Ошибка")
+		return
+	}
+
+	//without moderation mode approved submissions are posted through queue
+	if state == ModerationApproved && !a.Config().Moderation.Enabled {
+		err = a.enqueueSubmission(memeId)
+		if err != nil {
+			a.Log.Errorf("Cannot enqueue approved meme %d. Reason %s", memeId, err)
+		}
+	}
+
+	if query.From.Username != "" {
+		text = fmt.Sprintf("%s @%s", text, query.From.Username)
+	}
+	a.Bot.editKeyboard(&telegram.EditMessageReplyMarkupParameters{
+		ChatID:    query.Message.Chat.ID,
+		MessageID: query.Message.ID,
+		ReplyMarkup: telegram.NewInlineKeyboardMarkup(telegram.NewInlineKeyboardRow(
+			telegram.NewInlineKeyboardButton(text, fmt.Sprintf("%sdone:%d", moderationPrefix, memeId)),
+		)),
+	})
+
+	answer(text)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+//ScoredMeme is candidate for posting with score calculated by scorer
+type ScoredMeme struct {
+	Meme
+	Score float64
+}
+
+var NoMemes = fmt.Errorf("No memes available")
+
+//candidateWindow is how old memes can be to be posted
+const candidateWindow = 24 * time.Hour
+
+//selectTopMemes returns up to n unshown memes of last day sorted by score
+func (a *App) selectTopMemes(chatId int64, scorer Scorer, n int) ([]ScoredMeme, error) {
+	memes, err := a.Storage.GetUnshownMemes(chatId, time.Now().Add(-candidateWindow))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get memes. Reason %s", err)
+	}
+
+	res := rankMemes(memes, scorer, a.Storage.Coeffs())
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res, nil
+}
+
+//rankMemes scores memes and sorts them from best
+func rankMemes(memes []Meme, scorer Scorer, coeffs *Coeffs) []ScoredMeme {
+	now := time.Now()
+	res := []ScoredMeme{}
+	for _, meme := range memes {
+		res = append(res, ScoredMeme{
+			Meme:  meme,
+			Score: scorer.Score(&meme, coeffs, now),
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Score > res[j].Score })
+	return res
+}
+
+//postTopMeme sends first meme from queue or best unshown meme to production chat and debug info to debug chat.
+//In moderation mode only approved memes are posted.
+func (a *App) postTopMeme() (*Meme, error) {
+	posted, err := a.postFromQueue(false)
+	if err != nil || posted != nil {
+		return posted, err
+	}
+
+	scorer, arm := a.chooseScorer(a.Config().TelegramBot.ChatId)
+
+	if a.Config().Moderation.Enabled {
+		return a.postModeratedMeme(scorer, arm)
+	}
+
+	memes, err := a.selectTopMemes(a.Config().TelegramBot.ChatId, scorer, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(memes) == 0 {
+		return nil, NoMemes
+	}
+
+	posted, _, err = a.postMeme(memes[0], scorer, arm)
+	return posted, err
+}
+
+//postMeme sends meme to production chat and returns id of message with keyboard
+func (a *App) postMeme(topMem ScoredMeme, scorer Scorer, arm string) (*Meme, int, error) {
+	a.Log.Infof("Top mem: %v", topMem)
+
+	caption, err := a.Caption(a.Config().TelegramBot.ChatId, "caption", &topMem.Meme, topMem.Score)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msgid, err := a.Bot.SendPhoto(topMem.Pictures, caption)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Cannot send photo to telegram. Reason %s", err)
+	}
+
+	//meme is sent already, returning error here would make caller post it again
+	err = a.Storage.MarkMemeShown(a.Config().TelegramBot.ChatId, msgid, topMem.Id, scorer.Name(), arm)
+	if err != nil {
+		a.Log.Errorf("Cannot mark meme %d shown. Reason %s", topMem.Id, err)
+	}
+
+	if topMem.Platform == PlatformSubmission {
+		a.notifySubmitter(&topMem.Meme)
+	}
+
+	debug := NewMemeDebug(topMem.Meme, scorer, a.Storage.Coeffs())
+	debug.Arm = arm
+	memeStr, _ := json.MarshalIndent(debug, "", "  ")
+
+	err = a.Bot.SendDebugText(fmt.Sprintf("Мем:\n%s", string(memeStr)))
+	if err != nil {
+		a.Log.Errorf("Cannot send debug info. Reason %s", err)
+	}
+
+	return &topMem.Meme, msgid, nil
+}
+
+//previewRunnersUp is how many next candidates are shown in dry run
+const previewRunnersUp = 10
+
+//PostPreview is what postTopMeme would post right now with one of scorers
+type PostPreview struct {
+	//Source is "queue", "moderation" or "top"
+	Source    string
+	QueueItem int    `json:",omitempty"`
+	Arm       string `json:",omitempty"`
+	//Chance is probability that slot is posted by this scorer, it is less than 1 for experiment arms
+	Chance  float64
+	Meme    MemeDebug
+	Caption MemeCaption
+	Media   []interface{}
+	//SeparateCaption is true for albums, caption is sent in next message with keyboard
+	SeparateCaption bool
+	RunnersUp       []MemeDebug
+}
+
+//previewTopMeme makes the same choice as postTopMeme but sends and writes nothing.
+//With experiment enabled arm of slot is random, so choice of every arm is returned.
+//Queue goes before experiment, so due queue item is the only choice.
+func (a *App) previewTopMeme() ([]*PostPreview, error) {
+	chatId := a.Config().TelegramBot.ChatId
+	scorer := a.queueScorer(chatId)
+	candidates, itemId, err := a.previewQueue(scorer)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) > 0 {
+		preview := &PostPreview{Source: "queue", QueueItem: itemId, Chance: 1}
+		err = a.fillPreview(preview, chatId, candidates, scorer)
+		if err != nil {
+			return nil, err
+		}
+		return []*PostPreview{preview}, nil
+	}
+
+	res := []*PostPreview{}
+	for _, choice := range a.scorerChoices(chatId) {
+		preview, err := a.previewSlot(chatId, choice.scorer, choice.arm)
+		if err != nil {
+			return nil, err
+		}
+		preview.Chance = choice.chance
+		res = append(res, preview)
+	}
+	return res, nil
+}
+
+//previewSlot is what postTopMeme would post with given scorer when queue is empty
+func (a *App) previewSlot(chatId int64, scorer Scorer, arm string) (*PostPreview, error) {
+	preview := &PostPreview{Arm: arm}
+
+	var candidates []ScoredMeme
+	var err error
+	if a.Config().Moderation.Enabled {
+		memes, err := a.Storage.GetApprovedMemes(chatId, time.Now().Add(-candidateWindow),
+			time.Duration(a.Config().Moderation.AutoApprove)*time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		if len(memes) == 0 {
+			return nil, NoApprovedMemes
+		}
+		preview.Source = "moderation"
+		candidates = rankApproved(memes, scorer, a.Storage.Coeffs())
+	} else {
+		candidates, err = a.selectTopMemes(chatId, scorer, previewRunnersUp+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(candidates) == 0 {
+			return nil, NoMemes
+		}
+		preview.Source = "top"
+	}
+
+	err = a.fillPreview(preview, chatId, candidates, scorer)
+	if err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+//fillPreview sets debug info, caption and media of first candidate and runners up
+func (a *App) fillPreview(preview *PostPreview, chatId int64, candidates []ScoredMeme, scorer Scorer) error {
+	if len(candidates) > previewRunnersUp+1 {
+		candidates = candidates[:previewRunnersUp+1]
+	}
+	coeffs := a.Storage.Coeffs()
+	top := candidates[0]
+	preview.Meme = NewMemeDebug(top.Meme, scorer, coeffs)
+	preview.Meme.Arm = preview.Arm
+	preview.RunnersUp = []MemeDebug{}
+	for _, meme := range candidates[1:] {
+		preview.RunnersUp = append(preview.RunnersUp, NewMemeDebug(meme.Meme, scorer, coeffs))
+	}
+
+	var err error
+	preview.Caption, err = a.Caption(chatId, "caption", &top.Meme, top.Score)
+	if err != nil {
+		return err
+	}
+	preview.SeparateCaption = len(top.Pictures) > 1
+	if preview.SeparateCaption {
+		preview.Media = albumMedia(top.Pictures, "")
+	} else {
+		preview.Media = albumMedia(top.Pictures, preview.Caption.Text)
+	}
+	return nil
+}
+
+//previewQueue returns unshown memes of due queue items in order of posting and id of first item.
+//Unlike postFromQueue it doesn't cancel shown items.
+func (a *App) previewQueue(scorer Scorer) ([]ScoredMeme, int, error) {
+	chatId := a.Config().TelegramBot.ChatId
+	items, err := a.Storage.getDueQueueItems(chatId, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	coeffs := a.Storage.Coeffs()
+	now := time.Now()
+	res := []ScoredMeme{}
+	firstId := 0
+	for _, item := range items {
+		shown, err := a.Storage.isMemeShown(chatId, item.MemeId)
+		if err != nil {
+			return nil, 0, err
+		}
+		if shown {
+			continue
+		}
+
+		meme, err := a.Storage.GetMemeById(item.MemeId)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Cannot get meme %d from queue. Reason %s", item.MemeId, err)
+		}
+		if firstId == 0 {
+			firstId = item.Id
+		}
+		res = append(res, ScoredMeme{Meme: *meme, Score: scorer.Score(meme, coeffs, now)})
+	}
+	return res, firstId, nil
+}
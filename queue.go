@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	QueuePending   = "pending"
+	QueueSending   = "sending"
+	QueueSent      = "sent"
+	QueueFailed    = "failed"
+	QueueCancelled = "cancelled"
+)
+
+//QueueConfig is [queue] section. CheckInterval and Backoff are in minutes.
+type QueueConfig struct {
+	CheckInterval int
+	MaxAttempts   int
+	Backoff       int
+}
+
+//QueueItem is meme waiting for posting. Scheduled is zero if meme is posted at next slot.
+type QueueItem struct {
+	Id          int
+	MemeId      int
+	ChatId      int64
+	Position    int
+	State       string
+	Scheduled   time.Time
+	Attempts    int
+	NextAttempt time.Time
+	Error       string
+	MsgId       int
+}
+
+func (c *QueueConfig) maxAttempts() int {
+	if c.MaxAttempts <= 0 {
+		return 5
+	}
+	return c.MaxAttempts
+}
+
+func (c *QueueConfig) checkInterval() time.Duration {
+	if c.CheckInterval <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.CheckInterval) * time.Minute
+}
+
+//backoff returns delay before next attempt, it doubles with every failed attempt
+func (c *QueueConfig) backoff(attempts int) time.Duration {
+	base := c.Backoff
+	if base <= 0 {
+		base = 1
+	}
+	return time.Duration(float64(base)*math.Pow(2, float64(attempts-1))) * time.Minute
+}
+
+func formatNullTime(t time.Time) sql.NullString {
+	if t.IsZero() {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.Format(ISO8601), Valid: true}
+}
+
+func parseNullTime(s sql.NullString) (time.Time, error) {
+	if !s.Valid || s.String == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(ISO8601, s.String)
+}
+
+//Enqueue adds meme to the end of queue. If scheduled is not zero meme is pinned to that time.
+func (s *Storage) Enqueue(chatId int64, memeId int, scheduled time.Time) (int, error) {
+	res, err := s.DB.Exec(`INSERT INTO post_queue (meme_id, chat_id, position, state, scheduled, attempts, created)
+VALUES (?, ?, (SELECT ifnull(max(position), 0) + 1 FROM post_queue WHERE chat_id = ?), ?, ?, 0, ?)`,
+		memeId, chatId, chatId, QueuePending, formatNullTime(scheduled), time.Now().Format(ISO8601))
+	if err != nil {
+		return 0, fmt.Errorf("Cannot add meme %d to queue. Reason %s", memeId, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("Cannot get last insert id. Reason %s", err)
+	}
+	return int(id), nil
+}
+
+func (s *Storage) parseQueueItems(rows *sql.Rows) ([]QueueItem, error) {
+	res := []QueueItem{}
+	for rows.Next() {
+		var (
+			item                   QueueItem
+			scheduled, nextAttempt sql.NullString
+			errStr                 sql.NullString
+			msgId                  sql.NullInt64
+		)
+		err := rows.Scan(&item.Id, &item.MemeId, &item.ChatId, &item.Position, &item.State, &scheduled, &item.Attempts, &nextAttempt, &errStr, &msgId)
+		if err != nil {
+			return res, fmt.Errorf("Cannot scan queue item. Reason %s", err)
+		}
+		item.Scheduled, err = parseNullTime(scheduled)
+		if err != nil {
+			return res, fmt.Errorf("Cannot parse scheduled time of queue item %d. Reason %s", item.Id, err)
+		}
+		item.NextAttempt, err = parseNullTime(nextAttempt)
+		if err != nil {
+			return res, fmt.Errorf("Cannot parse next attempt time of queue item %d. Reason %s", item.Id, err)
+		}
+		item.Error = errStr.String
+		item.MsgId = int(msgId.Int64)
+		res = append(res, item)
+	}
+	return res, nil
+}
+
+const queueColumns = "id, meme_id, chat_id, position, state, scheduled, attempts, next_attempt, error, msg_id"
+
+//GetQueue returns pending items of chat. Pinned items go first in order of time, then others by position.
+func (s *Storage) GetQueue(chatId int64) ([]QueueItem, error) {
+	rows, err := s.DB.Query(fmt.Sprintf(`SELECT %s FROM post_queue WHERE chat_id = ? and state = ?
+ORDER BY scheduled IS NULL, scheduled, position`, queueColumns), chatId, QueuePending)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get queue. Reason %s", err)
+	}
+	defer rows.Close()
+	return s.parseQueueItems(rows)
+}
+
+//getDueQueueItems returns pending items which can be posted now.
+//If pinnedOnly is set, items for next slot without failed attempts are skipped.
+func (s *Storage) getDueQueueItems(chatId int64, pinnedOnly bool) ([]QueueItem, error) {
+	now := time.Now().Format(ISO8601)
+	rows, err := s.DB.Query(fmt.Sprintf(`SELECT %s FROM post_queue WHERE chat_id = ? and state = ?
+and (scheduled IS NULL or scheduled <= ?) and (next_attempt IS NULL or next_attempt <= ?)
+and (? == 0 or scheduled IS NOT NULL or attempts > 0)
+ORDER BY scheduled IS NULL, scheduled, position`, queueColumns), chatId, QueuePending, now, now, pinnedOnly)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get due queue items. Reason %s", err)
+	}
+	defer rows.Close()
+	return s.parseQueueItems(rows)
+}
+
+//claimQueueItem moves pending item to sending state. It returns false if item is taken by another poster.
+func (s *Storage) claimQueueItem(id int) (bool, error) {
+	res, err := s.DB.Exec("UPDATE post_queue SET state = ? WHERE id = ? and state = ?", QueueSending, id, QueuePending)
+	if err != nil {
+		return false, fmt.Errorf("Cannot claim queue item %d. Reason %s", id, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Cannot get affected rows. Reason %s", err)
+	}
+	return n == 1, nil
+}
+
+//failInterruptedQueueItems marks items left in sending state by crash as failed,
+//they could be sent already, so they are not retried automatically
+func (s *Storage) failInterruptedQueueItems() error {
+	_, err := s.DB.Exec("UPDATE post_queue SET state = ?, error = ? WHERE state = ?",
+		QueueFailed, "interrupted while sending", QueueSending)
+	if err != nil {
+		return fmt.Errorf("Cannot fail interrupted queue items. Reason %s", err)
+	}
+	return nil
+}
+
+func (s *Storage) setQueueState(id int, state string, msgId int) error {
+	_, err := s.DB.Exec("UPDATE post_queue SET state = ?, msg_id = ? WHERE id = ?", state, msgId, id)
+	if err != nil {
+		return fmt.Errorf("Cannot set state of queue item %d. Reason %s", id, err)
+	}
+	return nil
+}
+
+//queueAttemptFailed records failed send. Item stays pending until attempts are exhausted.
+func (s *Storage) queueAttemptFailed(item QueueItem, sendErr error, cfg *QueueConfig) error {
+	attempts := item.Attempts + 1
+	state := QueuePending
+	if attempts >= cfg.maxAttempts() {
+		state = QueueFailed
+	}
+	_, err := s.DB.Exec("UPDATE post_queue SET state = ?, attempts = ?, next_attempt = ?, error = ? WHERE id = ?",
+		state, attempts, time.Now().Add(cfg.backoff(attempts)).Format(ISO8601), sendErr.Error(), item.Id)
+	if err != nil {
+		return fmt.Errorf("Cannot record failed attempt of queue item %d. Reason %s", item.Id, err)
+	}
+	return nil
+}
+
+//CancelQueueItem cancels pending item
+func (s *Storage) CancelQueueItem(id int) error {
+	res, err := s.DB.Exec("UPDATE post_queue SET state = ? WHERE id = ? and state = ?", QueueCancelled, id, QueuePending)
+	if err != nil {
+		return fmt.Errorf("Cannot cancel queue item %d. Reason %s", id, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Cannot get affected rows. Reason %s", err)
+	}
+	if n == 0 {
+		return NotFound
+	}
+	return nil
+}
+
+//PinQueueItem sets time when item is posted. Zero time unpins item.
+func (s *Storage) PinQueueItem(id int, scheduled time.Time) error {
+	res, err := s.DB.Exec("UPDATE post_queue SET scheduled = ? WHERE id = ? and state = ?", formatNullTime(scheduled), id, QueuePending)
+	if err != nil {
+		return fmt.Errorf("Cannot pin queue item %d. Reason %s", id, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Cannot get affected rows. Reason %s", err)
+	}
+	if n == 0 {
+		return NotFound
+	}
+	return nil
+}
+
+//MoveQueueItem moves pending item to position (starting from 1) and renumbers other items
+func (s *Storage) MoveQueueItem(chatId int64, id int, position int) error {
+	rows, err := s.DB.Query("SELECT id FROM post_queue WHERE chat_id = ? and state = ? ORDER BY position", chatId, QueuePending)
+	if err != nil {
+		return fmt.Errorf("Cannot get queue. Reason %s", err)
+	}
+	ids := []int{}
+	found := false
+	for rows.Next() {
+		var itemId int
+		err = rows.Scan(&itemId)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("Cannot scan queue item. Reason %s", err)
+		}
+		if itemId == id {
+			found = true
+			continue
+		}
+		ids = append(ids, itemId)
+	}
+	rows.Close()
+
+	if !found {
+		return NotFound
+	}
+	if position < 1 {
+		position = 1
+	}
+	if position > len(ids)+1 {
+		position = len(ids) + 1
+	}
+	ids = append(ids[:position-1], append([]int{id}, ids[position-1:]...)...)
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("Cannot begin transaction. Reason %s", err)
+	}
+	for i, itemId := range ids {
+		_, err = tx.Exec("UPDATE post_queue SET position = ? WHERE id = ?", i+1, itemId)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Cannot update position of queue item %d. Reason %s", itemId, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Cannot commit positions. Reason %s", err)
+	}
+	return nil
+}
+
+func (s *Storage) isMemeShown(chatId int64, memeId int) (bool, error) {
+	exist := 0
+	err := s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM shown_memes WHERE chat_id = ? and meme_id = ?)", chatId, memeId).Scan(&exist)
+	if err != nil {
+		return false, fmt.Errorf("Cannot check is meme %d shown. Reason %s", memeId, err)
+	}
+	return exist == 1, nil
+}
+
+//QueueScorerName is scorer of posts from queue. Scorer and arm didn't choose these memes,
+//so they are posted without arm and not counted for experiment.
+const QueueScorerName = "queue"
+
+//queueScorer scores memes with scorer of chat for caption and debug info, but names itself QueueScorerName
+type queueScorer struct {
+	Scorer
+}
+
+func (s queueScorer) Name() string {
+	return QueueScorerName
+}
+
+//queueScorer returns scorer which queued memes of chat are posted with
+func (a *App) queueScorer(chatId int64) Scorer {
+	return queueScorer{a.getScorer(chatId)}
+}
+
+//postFromQueue posts first due item of queue. It returns nil meme if nothing is due.
+func (a *App) postFromQueue(pinnedOnly bool) (*Meme, error) {
+	chatId := a.Config().TelegramBot.ChatId
+	scorer := a.queueScorer(chatId)
+	items, err := a.Storage.getDueQueueItems(chatId, pinnedOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		//scheduler, HTTP and bot can post at the same time, item is sent only by one who claimed it
+		claimed, err := a.Storage.claimQueueItem(item.Id)
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			continue
+		}
+
+		shown, err := a.Storage.isMemeShown(chatId, item.MemeId)
+		if err != nil {
+			a.Storage.setQueueState(item.Id, QueuePending, 0)
+			return nil, err
+		}
+		if shown {
+			a.Log.Infof("Meme %d from queue item %d is already shown", item.MemeId, item.Id)
+			err = a.Storage.setQueueState(item.Id, QueueCancelled, 0)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		meme, err := a.Storage.GetMemeById(item.MemeId)
+		if err != nil {
+			a.Storage.setQueueState(item.Id, QueuePending, 0)
+			return nil, fmt.Errorf("Cannot get meme %d from queue. Reason %s", item.MemeId, err)
+		}
+
+		posted, msgid, err := a.postMeme(ScoredMeme{Meme: *meme, Score: scorer.Score(meme, a.Storage.Coeffs(), time.Now())}, scorer, "")
+		if err != nil && msgid == 0 {
+			a.Log.Errorf("Cannot post queue item %d. Reason %s", item.Id, err)
+			errFailed := a.Storage.queueAttemptFailed(item, err, &a.Config().Queue)
+			if errFailed != nil {
+				a.Log.Errorf("%s", errFailed)
+			}
+			return nil, err
+		}
+		if err != nil {
+			a.Log.Errorf("Queue item %d is sent, but cannot finish posting. Reason %s", item.Id, err)
+		}
+
+		//meme is in channel already, so errors of bookkeeping must not lead to repost
+		err = a.Storage.setQueueState(item.Id, QueueSent, msgid)
+		if err != nil {
+			a.Log.Errorf("%s", err)
+		}
+		return posted, nil
+	}
+	return nil, nil
+}
+
+//startQueueScheduler posts pinned memes when their time comes and retries failed sends
+func (a *App) startQueueScheduler(ctx context.Context) {
+	err := a.Storage.failInterruptedQueueItems()
+	if err != nil {
+		a.Log.Errorf("%s", err)
+	}
+	interval := a.Config().Queue.checkInterval()
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-a.configReloaded():
+				newInterval := a.Config().Queue.checkInterval()
+				if newInterval != interval {
+					interval = newInterval
+					ticker.Reset(interval)
+				}
+				continue
+			case <-ticker.C:
+			}
+			if !a.tasks.start() {
+				return
+			}
+			_, err := a.postFromQueue(true)
+			if err != nil {
+				a.Log.Errorf("Cannot post from queue. Reason %s", err)
+			}
+			a.tasks.done()
+		}
+	}()
+}
+
+//parseSlotTime parses RFC3339 time or HH:MM of nearest such time in future
+func parseSlotTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t.Local(), nil
+	}
+	clock, err := time.ParseInLocation("15:04", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Wrong time %q, expected RFC3339 or HH:MM", s)
+	}
+	now := time.Now()
+	t = time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local)
+	if t.Before(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -9,6 +10,8 @@ import (
 	"path"
 	"strings"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type Reddit struct {
@@ -22,6 +25,8 @@ type Reddit struct {
 
 	accessToken string
 	tokenType   string
+	storage     *Storage
+	log         *log.Logger
 }
 
 type RedditAuthResponse struct {
@@ -61,7 +66,7 @@ func (r *Reddit) updateToken() (string, string, error) {
 	return response.AccessToken, response.TokenType, nil
 }
 
-func (r *Reddit) sendRequestNoCheck(method, redditPath string, params map[string]interface{}) (*http.Response, error) {
+func (r *Reddit) sendRequestNoCheck(ctx context.Context, method, redditPath string, params map[string]interface{}) (*http.Response, error) {
 	cli := &http.Client{}
 	u, err := url.Parse("https://oauth.reddit.com")
 	if err != nil {
@@ -78,11 +83,12 @@ func (r *Reddit) sendRequestNoCheck(method, redditPath string, params map[string
 	if err != nil {
 		return nil, fmt.Errorf("Cannot create request for reddit. Reason %s", err)
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("User-Agent", r.UserAgent)
-	req.Header.Set("Authorization", fmt.Sprintf("%s %s", r.tokenType, r.accessToken))
-
+	//request is dumped before token is set, so token is not written to log
 	dump, err := httputil.DumpRequest(req, true)
-	Log.Infof("dump %s %s", dump, err)
+	r.log.Debugf("dump %s %s", dump, err)
+	req.Header.Set("Authorization", fmt.Sprintf("%s %s", r.tokenType, r.accessToken))
 
 	resp, err := cli.Do(req)
 	if err != nil {
@@ -90,7 +96,7 @@ func (r *Reddit) sendRequestNoCheck(method, redditPath string, params map[string
 	}
 
 	/*dump, err = httputil.DumpResponse(resp, true)
-	Log.Infof("dump response %s %s", dump, err)*/
+	r.log.Infof("dump response %s %s", dump, err)*/
 
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("Wrong status code %d %s for reddit req", resp.StatusCode, resp.Status)
@@ -99,25 +105,36 @@ func (r *Reddit) sendRequestNoCheck(method, redditPath string, params map[string
 	return resp, nil
 }
 
-func (r *Reddit) sendRequest(method, path string, params map[string]interface{}) (*http.Response, error) {
-	return r.sendRequestNoCheck(method, path, params)
+func (r *Reddit) sendRequest(ctx context.Context, method, path string, params map[string]interface{}) (*http.Response, error) {
+	return r.sendRequestNoCheck(ctx, method, path, params)
 }
 
-func (r *Reddit) update() {
-	until := time.Now().Add(-time.Duration(r.LookingDuration) * time.Hour)
-	err := r.updateMemes(until)
+//update fetches memes with settings of config snapshot cfg
+func (r *Reddit) update(ctx context.Context, cfg *TomlConfig) {
+	until := time.Now().Add(-time.Duration(cfg.Reddit.LookingDuration) * time.Hour)
+	err := r.updateMemes(ctx, until, cfg)
 	if err != nil {
-		Log.Errorf("Cannot update memes. Reason %s", err)
+		r.log.Errorf("Cannot update memes. Reason %s", err)
 	}
 }
 
-func (r *Reddit) updateMemes(from time.Time) error {
-	for _, public := range r.Publics {
+func (r *Reddit) updateMemes(ctx context.Context, from time.Time, cfg *TomlConfig) error {
+	for _, public := range cfg.Reddit.Publics {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		disabled, err := r.storage.IsPublicDisabled("reddit", public)
+		if err != nil {
+			return err
+		}
+		if disabled {
+			continue
+		}
 		last := ""
 		count := 0
 	SubredditGet:
 		for {
-			resp, err := r.sendRequest("GET", fmt.Sprintf("/r/%s/new.json", public), map[string]interface{}{
+			resp, err := r.sendRequest(ctx, "GET", fmt.Sprintf("/r/%s/new.json", public), map[string]interface{}{
 				"after": last,
 			})
 			if err != nil {
@@ -157,10 +174,12 @@ func (r *Reddit) updateMemes(from time.Time) error {
 					Views:       post.Data.SubredditSubscribers,
 					Comments:    post.Data.NumComments,
 					Time:        time.Unix(int64(post.Data.Created), 0),
+					Author:      fmt.Sprintf("/u/%s", post.Data.Author),
+					Link:        fmt.Sprintf("https://www.reddit.com%s", post.Data.Permalink),
 				}
-				err = storage.AddMeme(mem)
+				err = r.storage.AddMeme(ctx, mem, cfg.Collision.Distance)
 				if err != nil {
-					Log.Errorf("Cannot add meme %v to storage. Reason %s", mem, err)
+					r.log.Errorf("Cannot add meme %v to storage. Reason %s", mem, err)
 				}
 			}
 		}
@@ -12,6 +12,8 @@ type RedditData struct {
 	Score                int     `json:"score"`
 	Pinned               bool    `json:"pinned"`
 	Name                 string  `json:"name"`
+	Author               string  `json:"author"`
+	Permalink            string  `json:"permalink"`
 	NumCrossposts        int     `json:"num_crossposts"`
 	NumComments          int     `json:"num_comments"`
 	SubredditSubscribers int     `json:"subreddit_subscribers"`
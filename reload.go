@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+//reloadNotifier closes channel after every reload and replaces it by new one, loops reset their tickers on it
+type reloadNotifier struct {
+	sync.Mutex
+	ch chan struct{}
+}
+
+func newReloadNotifier() *reloadNotifier {
+	return &reloadNotifier{ch: make(chan struct{})}
+}
+
+//wait returns channel which is closed on next reload
+func (n *reloadNotifier) wait() <-chan struct{} {
+	n.Lock()
+	defer n.Unlock()
+	return n.ch
+}
+
+func (n *reloadNotifier) notify() {
+	n.Lock()
+	defer n.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
+//configReloaded returns channel which is closed on next reload of config
+func (a *App) configReloaded() <-chan struct{} {
+	return a.reloaded.wait()
+}
+
+//ReloadResult lists changed settings. RestartRequired settings are kept old until restart.
+type ReloadResult struct {
+	Applied         []string
+	RestartRequired []string
+}
+
+//configField is setting compared on reload
+type configField struct {
+	name     string
+	old, new interface{}
+}
+
+func changedFields(fields []configField) []string {
+	res := []string{}
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.old, f.new) {
+			res = append(res, f.name)
+		}
+	}
+	return res
+}
+
+//liveFields are settings applied by reload without restart
+func liveFields(old, new *TomlConfig) []configField {
+	return []configField{
+		{"metric", old.Metric, new.Metric},
+		{"collision.distance", old.Collision.Distance, new.Collision.Distance},
+		{"vk.publics", old.VK.Publics, new.VK.Publics},
+		{"vk.spam_filter", old.VK.SpamFilter, new.VK.SpamFilter},
+		{"vk.link_format", old.VK.LinkFormat, new.VK.LinkFormat},
+		{"vk.request_timeout", old.VK.RequestTimeout, new.VK.RequestTimeout},
+		{"vk.looking_duration", old.VK.LookingDuration, new.VK.LookingDuration},
+		{"vk.update_timeout", old.VK.UpdateTimeout, new.VK.UpdateTimeout},
+		{"reddit.publics", old.Reddit.Publics, new.Reddit.Publics},
+		{"reddit.looking_duration", old.Reddit.LookingDuration, new.Reddit.LookingDuration},
+		{"telegram.looking_duration", old.Telegram.LookingDuration, new.Telegram.LookingDuration},
+		{"telegram.load_step", old.Telegram.LoadStep, new.Telegram.LoadStep},
+		{"telegram.publics", old.Telegram.Publics, new.Telegram.Publics},
+		{"queue", old.Queue, new.Queue},
+		{"retention.days", old.Retention.Days, new.Retention.Days},
+		{"retention.archive_days", old.Retention.ArchiveDays, new.Retention.ArchiveDays},
+		{"retention.interval", old.Retention.Interval, new.Retention.Interval},
+		{"backup.dir", old.Backup.Dir, new.Backup.Dir},
+		{"backup.interval", old.Backup.Interval, new.Backup.Interval},
+		{"backup.keep", old.Backup.Keep, new.Backup.Keep},
+		{"backup.send_to_debug", old.Backup.SendToDebug, new.Backup.SendToDebug},
+	}
+}
+
+//restartFields are settings used when connections, storage and loops are created
+func restartFields(old, new *TomlConfig) []configField {
+	return []configField{
+		{"title", old.Title, new.Title},
+		{"serve_address", old.ServeAddress, new.ServeAddress},
+		{"db", old.DB, new.DB},
+		{"vk.token", old.VK.Token, new.VK.Token},
+		{"vk.server_address", old.VK.ServerAddress, new.VK.ServerAddress},
+		{"vk.vk_api_version", old.VK.VkApiVersion, new.VK.VkApiVersion},
+		{"reddit.app_id", old.Reddit.AppId, new.Reddit.AppId},
+		{"reddit.secret", old.Reddit.Secret, new.Reddit.Secret},
+		{"reddit.username", old.Reddit.Username, new.Reddit.Username},
+		{"reddit.password", old.Reddit.Password, new.Reddit.Password},
+		{"reddit.user_agent", old.Reddit.UserAgent, new.Reddit.UserAgent},
+		{"telegram.app_id", old.Telegram.AppID, new.Telegram.AppID},
+		{"telegram.app_hash", old.Telegram.AppHash, new.Telegram.AppHash},
+		{"telegram.phone_number", old.Telegram.PhoneNumber, new.Telegram.PhoneNumber},
+		{"telegram.ip", old.Telegram.IP, new.Telegram.IP},
+		{"telegram.port", old.Telegram.Port, new.Telegram.Port},
+		{"telegram_bot.token", old.TelegramBot.Token, new.TelegramBot.Token},
+		{"telegram_bot.chat_id", old.TelegramBot.ChatId, new.TelegramBot.ChatId},
+		{"telegram_bot.chat_id_debug", old.TelegramBot.ChatIdDebug, new.TelegramBot.ChatIdDebug},
+		{"telegram_bot.admins", old.TelegramBot.Admins, new.TelegramBot.Admins},
+		{"telegram_bot.workers", old.TelegramBot.Workers, new.TelegramBot.Workers},
+		{"moderation", old.Moderation, new.Moderation},
+		{"submission", old.Submission, new.Submission},
+		{"i18n", old.I18n, new.I18n},
+		{"retention.enabled", old.Retention.Enabled, new.Retention.Enabled},
+		{"retention.archive", old.Retention.Archive, new.Retention.Archive},
+		{"backup.enabled", old.Backup.Enabled, new.Backup.Enabled},
+		{"log", old.Log, new.Log},
+	}
+}
+
+//reloadConfig reads config file again and applies settings which can be changed live.
+//Invalid config is rejected as whole and nothing is changed.
+func (a *App) reloadConfig() (*ReloadResult, error) {
+	cfg, err := getConfig(a.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	set, err := initScorers(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	a.reloadMu.Lock()
+	old := a.Config()
+	res := &ReloadResult{
+		Applied:         changedFields(liveFields(old, cfg)),
+		RestartRequired: changedFields(restartFields(old, cfg)),
+	}
+	//old snapshot may be used by running jobs, so new one is its copy with live settings of new file
+	next := *old
+	next.Metric = cfg.Metric
+	next.Collision = cfg.Collision
+	next.VK.Publics = cfg.VK.Publics
+	next.VK.SpamFilter = cfg.VK.SpamFilter
+	next.VK.LinkFormat = cfg.VK.LinkFormat
+	next.VK.RequestTimeout = cfg.VK.RequestTimeout
+	next.VK.LookingDuration = cfg.VK.LookingDuration
+	next.VK.UpdateTimeout = cfg.VK.UpdateTimeout
+	next.Reddit.Publics = cfg.Reddit.Publics
+	next.Reddit.LookingDuration = cfg.Reddit.LookingDuration
+	next.Telegram.LookingDuration = cfg.Telegram.LookingDuration
+	next.Telegram.LoadStep = cfg.Telegram.LoadStep
+	next.Telegram.Publics = cfg.Telegram.Publics
+	next.Queue = cfg.Queue
+	next.Retention.Days = cfg.Retention.Days
+	next.Retention.ArchiveDays = cfg.Retention.ArchiveDays
+	next.Retention.Interval = cfg.Retention.Interval
+	next.Backup.Dir = cfg.Backup.Dir
+	next.Backup.Interval = cfg.Backup.Interval
+	next.Backup.Keep = cfg.Backup.Keep
+	next.Backup.SendToDebug = cfg.Backup.SendToDebug
+	next.scorers = set
+	a.config.Store(&next)
+	a.reloadMu.Unlock()
+
+	//coefficients depend on scoring parameters
+	err = a.calculateCoeffs()
+	if err != nil {
+		a.Log.Errorf("Cannot calculate coefficients after reload. Reason %s", err)
+	}
+	a.reloaded.notify()
+
+	a.Log.Infof("Config is reloaded. Applied: %v. Restart required: %v", res.Applied, res.RestartRequired)
+	return res, nil
+}
+
+func (a *App) reloadConfigHandler(wr http.ResponseWriter, req *http.Request) {
+	res, err := a.reloadConfig()
+	if err != nil {
+		a.Log.Errorf("Cannot reload config. Reason %s", err)
+		http.Error(wr, fmt.Sprintf("Cannot reload config. Reason %s", err), http.StatusBadRequest)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(wr).Encode(res)
+	if err != nil {
+		a.Log.Errorf("Cannot encode reload result. Reason %s", err)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//RetentionConfig is [retention] section. Days are counted from time meme was published in source,
+//Interval is in hours.
+type RetentionConfig struct {
+	Enabled     bool
+	Days        int
+	ArchiveDays int
+	Archive     string
+	Interval    int
+}
+
+func (c *RetentionConfig) days() int {
+	if c.Days <= 0 {
+		return 30
+	}
+	return c.Days
+}
+
+func (c *RetentionConfig) archiveDays() int {
+	if c.ArchiveDays <= 0 {
+		return 180
+	}
+	return c.ArchiveDays
+}
+
+func (c *RetentionConfig) archive() string {
+	if c.Archive == "" {
+		return "archive.db"
+	}
+	return c.Archive
+}
+
+func (c *RetentionConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.Interval) * time.Hour
+}
+
+//postedFilter selects memes which were posted or rejected by moderators, they are history of votes
+const postedFilter = `(EXISTS(
+	select 1 from shown_memes as sm where sm.meme_id == m.id and sm.msg_id != 0
+) or EXISTS(
+	select 1 from moderation as md where md.meme_id == m.id and md.state == '` + ModerationRejected + `'
+))`
+
+//keptFilter selects memes which are still waiting for moderators or in publish queue
+const keptFilter = `(EXISTS(
+	select 1 from moderation as md where md.meme_id == m.id and md.state in ('` + ModerationPending + `', '` + ModerationApproved + `')
+) or EXISTS(
+	select 1 from post_queue as q where q.meme_id == m.id and q.state == '` + QueuePending + `'
+))`
+
+//applyRetention drops old memes which were never posted and moves old posted memes with their votes to archive.
+//Hashes of removed memes are kept in dedup_hashes, so reposts of them are still found.
+func (s *Storage) applyRetention(ctx context.Context, cfg RetentionConfig) error {
+	conn, err := s.DB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("Cannot get db connection. Reason %s", err)
+	}
+	defer conn.Close()
+
+	//attached database is visible only in connection which attached it
+	_, err = conn.ExecContext(ctx, "ATTACH DATABASE ? AS archive", cfg.archive())
+	if err != nil {
+		return fmt.Errorf("Cannot attach archive %s. Reason %s", cfg.archive(), err)
+	}
+	defer func() {
+		_, err := conn.ExecContext(context.Background(), "DETACH DATABASE archive")
+		if err != nil {
+			s.log.Errorf("Cannot detach archive. Reason %s", err)
+		}
+	}()
+
+	columns, err := migrateArchive(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Cannot begin retention transaction. Reason %s", err)
+	}
+	dropped, archived, err := s.retain(ctx, tx, cfg, columns)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Cannot commit retention. Reason %s", err)
+	}
+	s.log.Infof("Retention dropped %d unposted memes and archived %d posted memes", dropped, archived)
+	return nil
+}
+
+//archivedTables are tables which rows of archived memes are moved to archive
+var archivedTables = []string{"memes", "shown_memes", "chat_metadata", "moderation"}
+
+//tableColumns returns names and types of columns of table in attached database db
+func tableColumns(ctx context.Context, conn *sql.Conn, db, table string) ([]string, map[string]string, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("PRAGMA %s.table_info(%s)", db, table))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot get columns of table %s.%s. Reason %s", db, table, err)
+	}
+	defer rows.Close()
+
+	names := []string{}
+	types := map[string]string{}
+	for rows.Next() {
+		var (
+			cid, notnull, pk int
+			name, ctype      string
+			dflt             sql.NullString
+		)
+		err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot scan column of table %s.%s. Reason %s", db, table, err)
+		}
+		names = append(names, name)
+		types[name] = ctype
+	}
+	return names, types, rows.Err()
+}
+
+//migrateArchive creates archive tables and adds columns which were added to main tables after archive was created.
+//It returns columns of every archived table, rows are copied by them as order of columns in archive may differ.
+func migrateArchive(ctx context.Context, conn *sql.Conn) (map[string][]string, error) {
+	res := map[string][]string{}
+	for _, table := range archivedTables {
+		_, err := conn.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS archive.%s AS SELECT * FROM main.%s WHERE 0", table, table))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot create archive table %s. Reason %s", table, err)
+		}
+
+		columns, types, err := tableColumns(ctx, conn, "main", table)
+		if err != nil {
+			return nil, err
+		}
+		_, archived, err := tableColumns(ctx, conn, "archive", table)
+		if err != nil {
+			return nil, err
+		}
+		for _, column := range columns {
+			if _, ok := archived[column]; ok {
+				continue
+			}
+			_, err = conn.ExecContext(ctx, fmt.Sprintf("ALTER TABLE archive.%s ADD COLUMN %s %s", table, column, types[column]))
+			if err != nil {
+				return nil, fmt.Errorf("Cannot add column %s to archive table %s. Reason %s", column, table, err)
+			}
+		}
+		res[table] = columns
+	}
+	return res, nil
+}
+
+//columnList joins columns for query, prefix is alias of table
+func columnList(columns []string, prefix string) string {
+	res := make([]string, len(columns))
+	for i, column := range columns {
+		res[i] = prefix + column
+	}
+	return strings.Join(res, ", ")
+}
+
+func (s *Storage) retain(ctx context.Context, tx *sql.Tx, cfg RetentionConfig, columns map[string][]string) (int, int, error) {
+	exec := func(query string, args ...interface{}) error {
+		_, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("Cannot apply retention. Query %q. Reason %s", query, err)
+		}
+		return nil
+	}
+
+	now := time.Now()
+	err := exec("DROP TABLE IF EXISTS temp.expired")
+	if err == nil {
+		err = exec("CREATE TEMP TABLE expired (id INTEGER PRIMARY KEY, archive INTEGER NOT NULL)")
+	}
+	if err == nil {
+		err = exec(fmt.Sprintf(`INSERT INTO temp.expired SELECT m.id, 0 FROM memes as m
+WHERE m.time < ? and not %s and not %s`, postedFilter, keptFilter), now.AddDate(0, 0, -cfg.days()).Format(ISO8601))
+	}
+	if err == nil {
+		err = exec(fmt.Sprintf(`INSERT INTO temp.expired SELECT m.id, 1 FROM memes as m
+WHERE m.time < ? and %s and not %s`, postedFilter, keptFilter), now.AddDate(0, 0, -cfg.archiveDays()).Format(ISO8601))
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var dropped, archived int
+	err = tx.QueryRowContext(ctx, "SELECT count(*) - coalesce(sum(archive), 0), coalesce(sum(archive), 0) FROM temp.expired").
+		Scan(&dropped, &archived)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Cannot count expired memes. Reason %s", err)
+	}
+
+	archive := func(table, alias, from, where string) string {
+		return fmt.Sprintf("INSERT INTO archive.%s (%s) SELECT %s FROM %s WHERE %s", table,
+			columnList(columns[table], ""), columnList(columns[table], alias), from, where)
+	}
+	queries := []string{
+		`INSERT OR IGNORE INTO dedup_hashes (hash, description) SELECT h.hash, m.description FROM meme_hashes as h
+join memes as m on m.id == h.meme_id WHERE h.meme_id IN (SELECT id FROM temp.expired)`,
+
+		archive("memes", "", "memes", "id IN (SELECT id FROM temp.expired WHERE archive == 1)"),
+		archive("shown_memes", "", "shown_memes", "meme_id IN (SELECT id FROM temp.expired WHERE archive == 1)"),
+		archive("chat_metadata", "cm.", `chat_metadata as cm join shown_memes as sm
+on sm.chat_id == cm.chat_id and sm.msg_id == cm.msg_id`, "sm.meme_id IN (SELECT id FROM temp.expired WHERE archive == 1)"),
+		archive("moderation", "", "moderation", "meme_id IN (SELECT id FROM temp.expired WHERE archive == 1)"),
+
+		//votes are found by messages, so they are deleted before messages
+		`DELETE FROM chat_metadata WHERE EXISTS(select 1 from shown_memes as sm
+where sm.chat_id == chat_metadata.chat_id and sm.msg_id == chat_metadata.msg_id and sm.meme_id IN (SELECT id FROM temp.expired))`,
+	}
+	for _, table := range []string{"meme_hashes", "shown_memes", "banned_memes", "moderation", "post_queue", "submissions"} {
+		queries = append(queries, fmt.Sprintf("DELETE FROM %s WHERE meme_id IN (SELECT id FROM temp.expired)", table))
+	}
+	if s.fts {
+		queries = append(queries, "DELETE FROM memes_fts WHERE rowid IN (SELECT id FROM temp.expired)")
+	}
+	queries = append(queries, "DELETE FROM memes WHERE id IN (SELECT id FROM temp.expired)", "DROP TABLE temp.expired")
+
+	for _, query := range queries {
+		err = exec(query)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return dropped, archived, nil
+}
+
+//optimize rebuilds database file and refreshes statistics of query planner
+func (s *Storage) optimize() error {
+	_, err := s.DB.Exec("VACUUM")
+	if err != nil {
+		return fmt.Errorf("Cannot vacuum db. Reason %s", err)
+	}
+	_, err = s.DB.Exec("ANALYZE")
+	if err != nil {
+		return fmt.Errorf("Cannot analyze db. Reason %s", err)
+	}
+	return nil
+}
+
+//startRetention applies retention policy and optimizes db every retention.interval hours
+func (a *App) startRetention(ctx context.Context) {
+	if !a.Config().Retention.Enabled {
+		return
+	}
+	interval := a.Config().Retention.interval()
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-a.configReloaded():
+				newInterval := a.Config().Retention.interval()
+				if newInterval != interval {
+					interval = newInterval
+					ticker.Reset(interval)
+				}
+				continue
+			case <-ticker.C:
+			}
+			if !a.tasks.start() {
+				return
+			}
+			cfg := a.Config().Retention
+			err := a.Storage.applyRetention(ctx, cfg)
+			if err != nil {
+				a.Log.Errorf("Cannot apply retention. Reason %s", err)
+			}
+			err = a.Storage.optimize()
+			if err != nil {
+				a.Log.Errorf("%s", err)
+			}
+			a.tasks.done()
+		}
+	}()
+}
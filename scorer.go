@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ScorerMultiplicative = "multiplicative"
+	ScorerWeighted       = "weighted"
+	ScorerExpression     = "expression"
+)
+
+//Scorer calculates KekScore for meme as if it was posted at given time. Bigger is better.
+type Scorer interface {
+	Name() string
+	Score(m *Meme, c *Coeffs, at time.Time) float64
+}
+
+//Coeffs are ratings and activities of groups and platforms which scores are normalized by.
+//Coeffs are shared between goroutines and must not be changed after they are stored.
+type Coeffs struct {
+	TimeCoeff float64
+	//Prior is rating of group or platform without votes, it is on the same scale as ratings with votes
+	Prior            Rating
+	GroupRatings     map[string]map[string]Rating
+	GroupActivity    map[string]map[string]float64
+	PlatformRatings  map[string]Rating
+	PlatformActivity map[string]float64
+	ComputedAt       time.Time
+}
+
+//newCoeffs returns coefficients without ratings, every group and platform gets prior rating
+func newCoeffs(metric *MetricConfig) *Coeffs {
+	return &Coeffs{
+		TimeCoeff: metric.Coeff,
+		Prior:     metric.Rating.newRating(0, 0),
+	}
+}
+
+//MetricConfig is [metric] section. Coeff is hours of time decay, ActivityWindow is in days.
+type MetricConfig struct {
+	Coeff          float64
+	ActivityWindow int
+	//DefaultGroupRating is ignored, groups without votes get prior rating. It is kept so old configs are parsed.
+	DefaultGroupRating map[string]float64
+	Scorer             string
+	ChatScorers        map[string]string
+	Scorers            map[string]ScorerConfig
+	Experiment         ExperimentConfig
+	Rating             RatingConfig
+	Taste              struct {
+		MinVotes float64
+	}
+}
+
+//RatingConfig is Beta prior of group ratings and half-life of votes in hours
+type RatingConfig struct {
+	PriorMean     float64
+	PriorStrength float64
+	HalfLife      float64
+}
+
+//ScorerConfig describes one named scorer from [metric.scorers.<name>] section
+type ScorerConfig struct {
+	Type    string
+	Weights map[string]float64
+	Formula string
+}
+
+//scoreVariables are names available for weighted and expression scorers
+var scoreVariables = []string{
+	"kekIndex",
+	"timeCoeff",
+	"groupRating",
+	"groupActivity",
+	"platformRating",
+	"platformActivity",
+	"likes",
+	"reposts",
+	"views",
+	"comments",
+	"hours",
+}
+
+//ScorerSet is scorers built from [metric] section with their assignment to chats.
+//It is swapped as whole when config is reloaded.
+type ScorerSet struct {
+	all        map[string]Scorer
+	def        string
+	chats      map[string]string
+	experiment ExperimentConfig
+}
+
+//currentScorers returns scorers of current config
+func (a *App) currentScorers() *ScorerSet {
+	return a.Config().scorers
+}
+
+func (m *Meme) scoreVariables(c *Coeffs, at time.Time) map[string]float64 {
+	return map[string]float64{
+		"kekIndex":         m.calculateKekIndex(),
+		"timeCoeff":        m.calculateTimeCoeff(c, at),
+		"groupRating":      m.calculateGroupRating(c),
+		"groupActivity":    m.calculateGroupActivity(c),
+		"platformRating":   m.calculatePlatformRating(c),
+		"platformActivity": m.calculatePlatformActivity(c),
+		"likes":            float64(m.Likes),
+		"reposts":          float64(m.Reposts),
+		"views":            float64(m.Views),
+		"comments":         float64(m.Comments),
+		"hours":            float64(at.Sub(m.Time)) / float64(time.Hour),
+	}
+}
+
+//MultiplicativeScorer is original formula:
+//kekIndex * timeCoeff / groupActivity * groupRating / platformActivity * platformRating
+type MultiplicativeScorer struct {
+	name string
+}
+
+func (s *MultiplicativeScorer) Name() string {
+	return s.name
+}
+
+func (s *MultiplicativeScorer) Score(m *Meme, c *Coeffs, at time.Time) float64 {
+	if m.Views == 0 {
+		return 0
+	}
+
+	score := m.calculateKekIndex() * m.calculateTimeCoeff(c, at)
+	score = score / m.calculateGroupActivity(c) * m.calculateGroupRating(c)
+	score = score / m.calculatePlatformActivity(c) * m.calculatePlatformRating(c)
+	return score
+}
+
+//WeightedSumScorer is sum of variables multiplied by weights, divided by sum of weights
+type WeightedSumScorer struct {
+	name    string
+	weights map[string]float64
+}
+
+func (s *WeightedSumScorer) Name() string {
+	return s.name
+}
+
+func (s *WeightedSumScorer) Score(m *Meme, c *Coeffs, at time.Time) float64 {
+	if m.Views == 0 {
+		return 0
+	}
+
+	vars := m.scoreVariables(c, at)
+	score := 0.0
+	summedWeight := 0.0
+	for name, weight := range s.weights {
+		score += weight * vars[name]
+		summedWeight += weight
+	}
+	if summedWeight == 0 {
+		return 0
+	}
+	return score / summedWeight
+}
+
+//ExpressionScorer evaluates formula from config
+type ExpressionScorer struct {
+	name    string
+	formula string
+	expr    expression
+}
+
+func (s *ExpressionScorer) Name() string {
+	return s.name
+}
+
+func (s *ExpressionScorer) Score(m *Meme, c *Coeffs, at time.Time) float64 {
+	if m.Views == 0 {
+		return 0
+	}
+	return s.expr(m.scoreVariables(c, at))
+}
+
+func isScoreVariable(name string) bool {
+	for _, v := range scoreVariables {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func NewScorer(name string, cfg ScorerConfig) (Scorer, error) {
+	switch strings.ToLower(cfg.Type) {
+	case ScorerMultiplicative:
+		return &MultiplicativeScorer{name: name}, nil
+	case ScorerWeighted:
+		if len(cfg.Weights) == 0 {
+			return nil, fmt.Errorf("Scorer %s has no weights", name)
+		}
+		for variable := range cfg.Weights {
+			if !isScoreVariable(variable) {
+				return nil, fmt.Errorf("Scorer %s has weight for unknown variable %s. Available %v", name, variable, scoreVariables)
+			}
+		}
+		return &WeightedSumScorer{name: name, weights: cfg.Weights}, nil
+	case ScorerExpression:
+		expr, err := compileExpression(cfg.Formula, scoreVariables)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot compile formula %q for scorer %s. Reason %s", cfg.Formula, name, err)
+		}
+		return &ExpressionScorer{name: name, formula: cfg.Formula, expr: expr}, nil
+	default:
+		return nil, fmt.Errorf("Unknown type %q for scorer %s", cfg.Type, name)
+	}
+}
+
+//initScorers creates all scorers from config. Multiplicative scorer is always available.
+func initScorers(config *TomlConfig) (*ScorerSet, error) {
+	res := map[string]Scorer{
+		ScorerMultiplicative: &MultiplicativeScorer{name: ScorerMultiplicative},
+	}
+	for name, cfg := range config.Metric.Scorers {
+		if name == QueueScorerName {
+			return nil, fmt.Errorf("Scorer name %s is reserved for posts from queue", name)
+		}
+		scorer, err := NewScorer(name, cfg)
+		if err != nil {
+			return nil, err
+		}
+		res[name] = scorer
+	}
+
+	def := config.Metric.Scorer
+	if def == "" {
+		def = ScorerMultiplicative
+	}
+	if _, ok := res[def]; !ok {
+		return nil, fmt.Errorf("Default scorer %s is not configured", def)
+	}
+	for chat, name := range config.Metric.ChatScorers {
+		if _, err := strconv.ParseInt(chat, 10, 64); err != nil {
+			return nil, fmt.Errorf("Wrong chat id %s in metric.chat_scorers. Reason %s", chat, err)
+		}
+		if _, ok := res[name]; !ok {
+			return nil, fmt.Errorf("Scorer %s for chat %s is not configured", name, chat)
+		}
+	}
+
+	err := config.Metric.Experiment.validate(res)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScorerSet{
+		all:        res,
+		def:        def,
+		chats:      config.Metric.ChatScorers,
+		experiment: config.Metric.Experiment,
+	}, nil
+}
+
+//get returns scorer configured for chat or default one
+func (s *ScorerSet) get(chatId int64) Scorer {
+	if name, ok := s.chats[strconv.FormatInt(chatId, 10)]; ok {
+		return s.all[name]
+	}
+	return s.all[s.def]
+}
+
+//getScorer returns scorer configured for chat or default one
+func (a *App) getScorer(chatId int64) Scorer {
+	return a.currentScorers().get(chatId)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testCoeffs are hand made coefficients: vk has votes and activity for one public, other publics get prior
+func testCoeffs() *Coeffs {
+	return &Coeffs{
+		TimeCoeff: 10,
+		Prior:     Rating{Value: 0.5},
+		GroupRatings: map[string]map[string]Rating{
+			"vk": {"rated": {Value: 0.8}},
+		},
+		GroupActivity: map[string]map[string]float64{
+			"vk": {"rated": 2},
+		},
+		PlatformRatings:  map[string]Rating{"vk": {Value: 0.6}},
+		PlatformActivity: map[string]float64{"vk": 4},
+	}
+}
+
+func TestScorers(t *testing.T) {
+	at := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	rated := Meme{Platform: "vk", Public: "rated", Likes: 100, Reposts: 10, Views: 1000, Time: at.Add(-10 * time.Hour)}
+	unrated := rated
+	unrated.Public = "unrated"
+	unseen := rated
+	unseen.Views = 0
+
+	//kekIndex is 100/1000 * 10/1000 * 1e6 = 1000, timeCoeff is 1/e after 10 hours
+	kek, decay := 1000.0, math.Exp(-1)
+
+	weighted, err := NewScorer("weighted", ScorerConfig{
+		Type:    ScorerWeighted,
+		Weights: map[string]float64{"groupRating": 3, "platformRating": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	formula, err := NewScorer("formula", ScorerConfig{
+		Type:    ScorerExpression,
+		Formula: "kekIndex * groupRating / groupActivity",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiplicative, err := NewScorer("multiplicative", ScorerConfig{Type: ScorerMultiplicative})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		scorer Scorer
+		meme   Meme
+		want   float64
+	}{
+		{multiplicative, rated, kek * decay / 2 * 0.8 / 4 * 0.6},
+		{multiplicative, unrated, kek * decay / 1 * 0.5 / 4 * 0.6},
+		{multiplicative, unseen, 0},
+		{weighted, rated, (3*0.8 + 0.6) / 4},
+		{weighted, unrated, (3*0.5 + 0.6) / 4},
+		{formula, rated, kek * 0.8 / 2},
+		{formula, unrated, kek * 0.5},
+		{formula, unseen, 0},
+	}
+	coeffs := testCoeffs()
+	for _, c := range cases {
+		got := c.scorer.Score(&c.meme, coeffs, at)
+		if math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%s scores %s/%s as %v, want %v", c.scorer.Name(), c.meme.Platform, c.meme.Public, got, c.want)
+		}
+	}
+}
+
+func TestRankMemes(t *testing.T) {
+	at := time.Now()
+	memes := []Meme{
+		{Id: 1, Platform: "vk", Public: "unrated", Likes: 100, Reposts: 10, Views: 1000, Time: at},
+		{Id: 2, Platform: "vk", Public: "rated", Likes: 100, Reposts: 10, Views: 1000, Time: at},
+		{Id: 3, Platform: "vk", Public: "rated", Likes: 10, Reposts: 1, Views: 1000, Time: at},
+	}
+	scorer, err := NewScorer("formula", ScorerConfig{Type: ScorerExpression, Formula: "kekIndex * groupRating"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranked := rankMemes(memes, scorer, testCoeffs())
+	order := []int{}
+	for _, meme := range ranked {
+		order = append(order, meme.Id)
+	}
+	if len(order) != 3 || order[0] != 2 || order[1] != 1 || order[2] != 3 {
+		t.Errorf("memes are ranked as %v, want [2 1 3]", order)
+	}
+}
+
+//TestCoeffsRecalculatedWhileScoring is meant for `go test -race`: coefficients are replaced
+//while other goroutines score memes with snapshots they loaded
+func TestCoeffsRecalculatedWhileScoring(t *testing.T) {
+	a, _ := newTestApp(t)
+	const chatId = 104
+	cfg := *a.Config()
+	cfg.TelegramBot.ChatId = chatId
+	cfg.Metric.Coeff = 10
+	a.config.Store(&cfg)
+
+	now := time.Now()
+	memes := []Meme{}
+	for i := 1; i <= 20; i++ {
+		meme := Meme{
+			MemeId:   strconv.Itoa(i),
+			Platform: "vk",
+			Public:   fmt.Sprintf("public%d", i%4),
+			Pictures: []string{fmt.Sprintf("https://example.com/%d.jpg", i)},
+			Likes:    i * 10,
+			Reposts:  i,
+			Views:    1000,
+			Time:     now.Add(-time.Duration(i) * time.Hour),
+		}
+		id, err := a.Storage.insertMeme(context.Background(), meme, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		meme.Id = id
+		memes = append(memes, meme)
+
+		err = a.Storage.MarkMemeShown(chatId, i, id, "multiplicative", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.Storage.MakeAction("telegram", chatId, i, 1, i%2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scorer, err := NewScorer("multiplicative", ScorerConfig{Type: ScorerMultiplicative})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//scoring goes on until recalculations are finished, so they always overlap
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	recalculated := make(chan struct{})
+	go func() {
+		defer close(recalculated)
+		for i := 0; i < 20; i++ {
+			err := a.calculateCoeffs()
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-recalculated:
+					return
+				default:
+				}
+				coeffs := a.Storage.Coeffs()
+				ranked := rankMemes(memes, scorer, coeffs)
+				for _, meme := range ranked {
+					if math.IsNaN(meme.Score) {
+						errs <- fmt.Errorf("meme %d has NaN score", meme.Id)
+						return
+					}
+				}
+				NewMemeDebug(ranked[0].Meme, scorer, coeffs)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if len(a.Storage.Coeffs().GroupRatings["vk"]) == 0 {
+		t.Errorf("group ratings are not calculated")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//shutdownTimeout is how long running fetches, posts and requests may take after signal
+const shutdownTimeout = 30 * time.Second
+
+//taskTracker counts running background work, shutdown waits for it before closing db
+type taskTracker struct {
+	sync.Mutex
+	stopping bool
+	wg       sync.WaitGroup
+}
+
+//start registers task, false is returned when shutdown is started and task must not run
+func (t *taskTracker) start() bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.stopping {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *taskTracker) done() {
+	t.wg.Done()
+}
+
+//wait forbids new tasks and waits for running ones until ctx is done
+func (t *taskTracker) wait(ctx context.Context) error {
+	t.Lock()
+	t.stopping = true
+	t.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Background tasks are not finished. Reason %s", ctx.Err())
+	}
+}
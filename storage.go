@@ -1,173 +1,210 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"math"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/gocarina/gocsv"
 	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
 )
 
-var storage *Storage
-
-var kekIndexWeight = 2.0
-var timeCoeffWeight = 1.0
-var groupCoeffWeight = 1.0
-var groupActivityWeight = 1.0
+//execer is *sql.DB or *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
 
 type Storage struct {
-	DB               *sql.DB
-	GroupRatings     map[string]map[string]float64
-	GroupActivity    map[string]map[string]float64
-	PlatformRatings  map[string]float64
-	PlatformActivity map[string]float64
+	DB     *sql.DB
+	coeffs atomic.Value
+	fts    bool
+	log    *log.Logger
+	//publicName is name of public which meme is indexed for search with, it is set by App
+	publicName func(m *Meme) string
+	//fileURL returns link to telegram file of submitted meme, it is set by App
+	fileURL func(fileId string) (string, error)
 }
 
-func (s *Storage) calculateGroupActivity() error {
-	res := map[string]map[string]float64{}
-	temp := map[string]map[string][]float64{}
-	memes, err := s.GetMemes(time.Unix(0, 0))
-	if err != nil {
-		return fmt.Errorf("Cannot get memes. Reason %s", err)
+//Coeffs returns snapshot of coefficients for scoring. Snapshot is never changed, calculateCoeffs replaces it.
+func (s *Storage) Coeffs() *Coeffs {
+	if c, ok := s.coeffs.Load().(*Coeffs); ok {
+		return c
 	}
+	return newCoeffs(&MetricConfig{})
+}
 
-	for _, meme := range memes {
-		if _, ok := temp[meme.Platform]; !ok {
-			temp[meme.Platform] = make(map[string][]float64)
-		}
-		temp[meme.Platform][meme.Public] = append(temp[meme.Platform][meme.Public], meme.calculateKekIndex())
+//activityWindow is period of memes which activity of groups and platforms is calculated from
+func (m *MetricConfig) activityWindow() time.Duration {
+	if m.ActivityWindow <= 0 {
+		return 30 * 24 * time.Hour
 	}
+	return time.Duration(m.ActivityWindow) * 24 * time.Hour
+}
+
+//calculateActivity calculates mean kek index of groups and mean normalized score of platforms
+//for memes of activity window. Group ratings have to be calculated before.
+func (s *Storage) calculateActivity(c *Coeffs, metric *MetricConfig) error {
+	rows, err := s.DB.Query(`SELECT platform, public, count(*),
+sum(CASE WHEN views > 0 THEN 1000000.0 * likes / views * reposts / views ELSE 0 END)
+FROM memes WHERE time > ? GROUP BY platform, public`, time.Now().Add(-metric.activityWindow()).Format(ISO8601))
+	if err != nil {
+		return fmt.Errorf("Cannot get activity of groups. Reason %s", err)
+	}
+	defer rows.Close()
 
-	for platform := range temp {
-		if _, ok := res[platform]; !ok {
-			res[platform] = make(map[string]float64)
+	groups := map[string]map[string]float64{}
+	platformScores := map[string]float64{}
+	platformCounts := map[string]int{}
+	for rows.Next() {
+		var (
+			platform, public string
+			count            int
+			sum              float64
+		)
+		err = rows.Scan(&platform, &public, &count, &sum)
+		if err != nil {
+			return fmt.Errorf("Cannot scan from row. Reason %s", err)
 		}
-		for public := range temp[platform] {
-			sum := float64(0)
-			for _, el := range temp[platform][public] {
-				sum += el
-			}
-			res[platform][public] = sum / float64(len(temp[platform][public]))
+		if _, ok := groups[platform]; !ok {
+			groups[platform] = map[string]float64{}
+		}
+		groups[platform][public] = sum / float64(count)
+
+		//every meme of group scores kekIndex / groupActivity * groupRating, so group adds count * groupRating
+		if sum > 0 {
+			meme := Meme{Platform: platform, Public: public}
+			platformScores[platform] += float64(count) * meme.calculateGroupRating(c)
 		}
+		platformCounts[platform] += count
+	}
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("Cannot read activity of groups. Reason %s", err)
 	}
 
-	s.GroupActivity = res
+	platforms := map[string]float64{}
+	for platform, count := range platformCounts {
+		platforms[platform] = platformScores[platform] / float64(count)
+	}
 
+	c.GroupActivity = groups
+	c.PlatformActivity = platforms
 	return nil
 }
 
-func (s *Storage) calculatePlatformActivity() error {
-	res := map[string]float64{}
-	temp := map[string][]float64{}
-	memes, err := s.GetMemes(time.Unix(0, 0))
-	if err != nil {
-		return fmt.Errorf("Cannot get memes. Reason %s", err)
-	}
+//Rating is posterior of like share with Beta prior. Likes and Dislikes are decayed by age.
+type Rating struct {
+	Likes    float64
+	Dislikes float64
+	Value    float64
+	Lower    float64
+	Upper    float64
+}
 
-	for _, meme := range memes {
-		score := meme.calculateKekIndex() / meme.calculateGroupActivity() * meme.calculateGroupRating()
-		temp[meme.Platform] = append(temp[meme.Platform], score)
+//newRating calculates posterior mean and 95% interval (normal approximation) of Beta distribution
+func (c *RatingConfig) newRating(likes, dislikes float64) Rating {
+	priorMean := c.PriorMean
+	if priorMean == 0 {
+		priorMean = 0.5
 	}
-
-	for platform := range temp {
-		sum := float64(0)
-		for _, el := range temp[platform] {
-			sum += el
-		}
-		res[platform] = sum / float64(len(temp[platform]))
+	priorStrength := c.PriorStrength
+	if priorStrength == 0 {
+		priorStrength = 10
 	}
 
-	s.PlatformActivity = res
+	alpha := likes + priorMean*priorStrength
+	beta := dislikes + (1-priorMean)*priorStrength
+	mean := alpha / (alpha + beta)
+	sd := math.Sqrt(alpha * beta / ((alpha + beta) * (alpha + beta) * (alpha + beta + 1)))
 
-	return nil
+	return Rating{
+		Likes:    likes,
+		Dislikes: dislikes,
+		Value:    mean,
+		Lower:    math.Max(0, mean-1.96*sd),
+		Upper:    math.Min(1, mean+1.96*sd),
+	}
 }
 
-func (s *Storage) calculateGroupRating(chatId int64) error {
+//voteWeight is weight of votes under post made at given time. Weight halves every HalfLife hours.
+func (c *RatingConfig) voteWeight(posted time.Time) float64 {
+	halfLife := c.HalfLife
+	if halfLife <= 0 {
+		return 1
+	}
+	age := float64(time.Now().Sub(posted)) / float64(time.Hour)
+	return math.Exp2(-age / halfLife)
+}
+
+//calculateGroupRating sets ratings of publics by votes and rejections in stats
+func calculateGroupRating(c *Coeffs, stats []MemeStat, rc *RatingConfig) {
 	type Counters struct {
 		Likes    float64
 		Dislikes float64
 	}
 
-	rating := map[string]map[string]float64{}
+	rating := map[string]map[string]Rating{}
 	counters := map[string]map[string]Counters{}
-	stats, err := s.getStatistics(chatId)
-	if err != nil {
-		return fmt.Errorf("Cannot get statistics. Reason %s", err)
-	}
-
 	for _, stat := range stats {
 		if _, ok := counters[stat.Platform]; !ok {
 			counters[stat.Platform] = make(map[string]Counters)
 		}
+		weight := rc.voteWeight(stat.Posted)
 		counter := counters[stat.Platform][stat.Public]
-		counter.Likes = counter.Likes + float64(stat.Likes)
-		counter.Dislikes = counter.Dislikes + float64(stat.Dislikes)
+		counter.Likes = counter.Likes + weight*float64(stat.Likes)
+		counter.Dislikes = counter.Dislikes + weight*float64(stat.Dislikes)
 		counters[stat.Platform][stat.Public] = counter
 	}
 
 	for platform := range counters {
 		for public := range counters[platform] {
 			if _, ok := rating[platform]; !ok {
-				rating[platform] = make(map[string]float64)
+				rating[platform] = make(map[string]Rating)
 			}
 			counters := counters[platform][public]
-			likes := counters.Likes
-			dislikes := counters.Dislikes
-			if likes+dislikes == 0 {
-				rating[platform][public] = 0.5
-			} else {
-				rating[platform][public] = -1.0/(math.Exp((likes-dislikes)/(likes+dislikes))+1) + 1
-			}
+			rating[platform][public] = rc.newRating(counters.Likes, counters.Dislikes)
 		}
 	}
 
-	s.GroupRatings = rating
-
-	return nil
+	c.GroupRatings = rating
 }
 
-func (s *Storage) calculatePlatformRating(chatId int64) error {
+//calculatePlatformRating sets ratings of platforms by votes and rejections in stats
+func calculatePlatformRating(c *Coeffs, stats []MemeStat, rc *RatingConfig) {
 	type Counters struct {
 		Likes    float64
 		Dislikes float64
 	}
 
-	rating := map[string]float64{}
+	rating := map[string]Rating{}
 	counters := map[string]Counters{}
-	stats, err := s.getStatistics(chatId)
-	if err != nil {
-		return fmt.Errorf("Cannot get statistics. Reason %s", err)
-	}
-
 	for _, stat := range stats {
+		weight := rc.voteWeight(stat.Posted)
 		counter := counters[stat.Platform]
-		counter.Likes += float64(stat.Likes)
-		counter.Dislikes += float64(stat.Dislikes)
+		counter.Likes += weight * float64(stat.Likes)
+		counter.Dislikes += weight * float64(stat.Dislikes)
 		counters[stat.Platform] = counter
 	}
 
 	for platform := range counters {
 		counters := counters[platform]
-		likes := counters.Likes
-		dislikes := counters.Dislikes
-		if likes+dislikes == 0 {
-			rating[platform] = 0.5
-		} else {
-			rating[platform] = -1.0/(math.Exp((likes-dislikes)/(likes+dislikes))+1) + 1
-		}
+		rating[platform] = rc.newRating(counters.Likes, counters.Dislikes)
 	}
 
-	s.PlatformRatings = rating
-
-	return nil
+	c.PlatformRatings = rating
 }
 
 const ISO8601 = "2006-01-02 15:04:05"
 
+//schemaVersion is stored in user_version of db, it is increased when schema changes
+const schemaVersion = 1
+
 var NotFound = fmt.Errorf("Doesn't exist")
 
 func (s *Storage) Init() error {
@@ -189,22 +226,57 @@ reposts INTEGER,
 views INTEGER,
 comments INTEGER,
 time TEXT NOT NULL,
+author TEXT,
+link TEXT,
 UNIQUE (memeid, public, platform)
 )`)
 	if err != nil {
 		return fmt.Errorf("Cannot create memes table. Reason %s", err)
 	}
 
+	err = s.addColumn("memes", "author", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = s.addColumn("memes", "link", "TEXT")
+	if err != nil {
+		return err
+	}
+
 	_, err = s.DB.Exec(`CREATE TABLE IF NOT EXISTS shown_memes (
 meme_id INTEGER NOT NULL,
 chat_id int NOT NULL,
 msg_id int NOT NULL,
+time TEXT,
+scorer TEXT,
+arm TEXT,
 FOREIGN KEY(meme_id) REFERENCES memes(id)
 )`)
 	if err != nil {
 		return fmt.Errorf("Cannot create shown_memes table. Reason %s", err)
 	}
 
+	err = s.addColumn("shown_memes", "time", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = s.addColumn("shown_memes", "scorer", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = s.addColumn("shown_memes", "arm", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.Exec(`CREATE INDEX IF NOT EXISTS memes_time ON memes (time)`)
+	if err != nil {
+		return fmt.Errorf("Cannot create index on memes time. Reason %s", err)
+	}
+
 	_, err = s.DB.Exec(`CREATE TABLE IF NOT EXISTS meme_hashes (
 meme_id INTEGER NOT NULL,
 hash TEXT NOT NULL,
@@ -214,6 +286,25 @@ FOREIGN KEY(meme_id) REFERENCES memes(id)
 		return fmt.Errorf("Cannot create meme_hashes table. Reason %s", err)
 	}
 
+	//dedup_hashes keeps hashes of memes removed by retention, they are used only for collision check
+	_, err = s.DB.Exec(`CREATE TABLE IF NOT EXISTS dedup_hashes (
+hash TEXT NOT NULL,
+description TEXT
+)`)
+	if err != nil {
+		return fmt.Errorf("Cannot create dedup_hashes table. Reason %s", err)
+	}
+
+	//older versions could save the same hash several times
+	_, err = s.DB.Exec("DELETE FROM dedup_hashes WHERE rowid NOT IN (SELECT min(rowid) FROM dedup_hashes GROUP BY hash)")
+	if err != nil {
+		return fmt.Errorf("Cannot remove duplicates from dedup_hashes. Reason %s", err)
+	}
+	_, err = s.DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS dedup_hashes_hash ON dedup_hashes (hash)`)
+	if err != nil {
+		return fmt.Errorf("Cannot create index on dedup_hashes. Reason %s", err)
+	}
+
 	_, err = s.DB.Exec(`CREATE TABLE IF NOT EXISTS chat_metadata (
 msg_id INTEGER NOT NULL,
 user_id INTEGER NOT NULL,
@@ -225,43 +316,154 @@ UNIQUE (msg_id, user_id, chat_id)
 		return fmt.Errorf("Cannot create chat table. Reason %s", err)
 	}
 
-	err = s.calculateCoeffs(Config.TelegramBot.ChatId)
+	_, err = s.DB.Exec(`CREATE INDEX IF NOT EXISTS chat_metadata_msg ON chat_metadata (chat_id, msg_id)`)
+	if err != nil {
+		return fmt.Errorf("Cannot create index on chat_metadata. Reason %s", err)
+	}
+
+	_, err = s.DB.Exec(`CREATE TABLE IF NOT EXISTS banned_memes (
+meme_id INTEGER NOT NULL UNIQUE,
+FOREIGN KEY(meme_id) REFERENCES memes(id)
+)`)
+	if err != nil {
+		return fmt.Errorf("Cannot create banned_memes table. Reason %s", err)
+	}
+
+	_, err = s.DB.Exec(`CREATE TABLE IF NOT EXISTS disabled_publics (
+platform TEXT NOT NULL,
+public TEXT NOT NULL,
+UNIQUE (platform, public)
+)`)
+	if err != nil {
+		return fmt.Errorf("Cannot create disabled_publics table. Reason %s", err)
+	}
+
+	_, err = s.DB.Exec(`CREATE TABLE IF NOT EXISTS moderation (
+meme_id INTEGER NOT NULL UNIQUE,
+chat_id INTEGER NOT NULL,
+msg_id INTEGER NOT NULL,
+state TEXT NOT NULL,
+user_id INTEGER,
+created TEXT NOT NULL,
+decided TEXT,
+FOREIGN KEY(meme_id) REFERENCES memes(id)
+)`)
+	if err != nil {
+		return fmt.Errorf("Cannot create moderation table. Reason %s", err)
+	}
+
+	_, err = s.DB.Exec(`CREATE TABLE IF NOT EXISTS post_queue (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+meme_id INTEGER NOT NULL,
+chat_id INTEGER NOT NULL,
+position INTEGER NOT NULL,
+state TEXT NOT NULL,
+scheduled TEXT,
+attempts INTEGER NOT NULL DEFAULT 0,
+next_attempt TEXT,
+error TEXT,
+msg_id INTEGER,
+created TEXT NOT NULL,
+FOREIGN KEY(meme_id) REFERENCES memes(id)
+)`)
 	if err != nil {
-		return fmt.Errorf("Cannot calculate coeffs. Reason %s", err)
+		return fmt.Errorf("Cannot create post_queue table. Reason %s", err)
+	}
+
+	//memes from queue were recorded with arm of slot before, they are not counted for experiment
+	_, err = s.DB.Exec(`UPDATE shown_memes SET scorer = ?, arm = NULL
+WHERE arm IS NOT NULL AND EXISTS (SELECT 1 FROM post_queue q
+WHERE q.chat_id = shown_memes.chat_id AND q.msg_id = shown_memes.msg_id AND q.state = ?)`, QueueScorerName, QueueSent)
+	if err != nil {
+		return fmt.Errorf("Cannot detach queue posts from experiment. Reason %s", err)
+	}
+
+	_, err = s.DB.Exec(`CREATE TABLE IF NOT EXISTS submissions (
+meme_id INTEGER NOT NULL UNIQUE,
+user_id INTEGER NOT NULL,
+name TEXT NOT NULL,
+created TEXT NOT NULL,
+FOREIGN KEY(meme_id) REFERENCES memes(id)
+)`)
+	if err != nil {
+		return fmt.Errorf("Cannot create submissions table. Reason %s", err)
+	}
+
+	err = s.initSearch()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion))
+	if err != nil {
+		return fmt.Errorf("Cannot set schema version. Reason %s", err)
 	}
 
 	return nil
 }
 
-func (s *Storage) calculateCoeffs(chatId int64) error {
-	var err error
-	err = s.calculateGroupRating(chatId)
+//addColumn adds column to table created by older version
+func (s *Storage) addColumn(table, column, definition string) error {
+	rows, err := s.DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
-		return fmt.Errorf("Cannot calculate group rating. Reason %s", err)
+		return fmt.Errorf("Cannot get columns of table %s. Reason %s", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notnull, pk int
+			name, ctype      string
+			dflt             sql.NullString
+		)
+		err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if err != nil {
+			return fmt.Errorf("Cannot scan column of table %s. Reason %s", table, err)
+		}
+		if name == column {
+			return nil
+		}
 	}
+	rows.Close()
 
-	err = s.calculateGroupActivity()
+	_, err = s.DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	if err != nil {
-		return fmt.Errorf("Cannot calculate group activity. Reason %s", err)
+		return fmt.Errorf("Cannot add column %s to table %s. Reason %s", column, table, err)
 	}
+	return nil
+}
 
-	err = s.calculatePlatformRating(chatId)
+//calculateCoeffs builds new snapshot of coefficients and replaces current one
+func (s *Storage) calculateCoeffs(chatId int64, metric *MetricConfig) error {
+	c := newCoeffs(metric)
+	//votes are loaded once for both ratings
+	stats, err := s.getStatistics(chatId)
+	if err != nil {
+		return fmt.Errorf("Cannot get statistics. Reason %s", err)
+	}
+	rejections, err := s.getRejections()
 	if err != nil {
-		return fmt.Errorf("Cannot calculate platform rating. Reason %s", err)
+		return fmt.Errorf("Cannot get rejections. Reason %s", err)
 	}
+	stats = append(stats, rejections...)
+
+	calculateGroupRating(c, stats, &metric.Rating)
+	calculatePlatformRating(c, stats, &metric.Rating)
 
-	err = s.calculatePlatformActivity()
+	err = s.calculateActivity(c, metric)
 	if err != nil {
-		return fmt.Errorf("Cannot calculate platform activity. Reason %s", err)
+		return fmt.Errorf("Cannot calculate activity. Reason %s", err)
 	}
 
+	c.ComputedAt = time.Now()
+	s.coeffs.Store(c)
 	return nil
 
 }
 
-func (s *Storage) isMemeExists(id, public, platform string) (bool, error) {
+func (s *Storage) isMemeExists(ctx context.Context, id, public, platform string) (bool, error) {
 	exist := 0
-	err := s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM memes WHERE platform = ? and public = ? and memeid = ?)", platform, public, id).Scan(&exist)
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM memes WHERE platform = ? and public = ? and memeid = ?)", platform, public, id).Scan(&exist)
 	return exist == 1, err
 }
 
@@ -281,96 +483,173 @@ func (s *Storage) GetMemeById(id int) (*Meme, error) {
 	return nil, NotFound
 }
 
-func (s *Storage) AddMeme(meme Meme) error {
-	isExist, err := s.isMemeExists(meme.MemeId, meme.Public, meme.Platform)
+//AddMeme saves fetched meme if it is new and unique. Download of pictures and insert stop when ctx is done.
+//Memes with pictures closer than distance and the same text are duplicates.
+func (s *Storage) AddMeme(ctx context.Context, meme Meme, distance int) error {
+	_, err := s.addMeme(ctx, meme, distance)
+	return err
+}
+
+//addMeme returns id of new meme or 0 if meme already exists or is not unique
+func (s *Storage) addMeme(ctx context.Context, meme Meme, distance int) (int, error) {
+	isExist, err := s.isMemeExists(ctx, meme.MemeId, meme.Public, meme.Platform)
 	if err != nil {
-		return fmt.Errorf("Cannot check is meme exist. Reason %s", err)
+		return 0, fmt.Errorf("Cannot check is meme exist. Reason %s", err)
 	}
 
 	if isExist {
-		return nil
+		return 0, nil
 	}
 
-	isUnique, hash, err := s.isUnique(&meme)
+	isUnique, hash, err := s.isUnique(ctx, &meme, distance)
 	if err != nil {
-		return fmt.Errorf("Cannot check is meme %v unique. Reason %s", meme, err)
+		return 0, fmt.Errorf("Cannot check is meme %v unique. Reason %s", meme, err)
 	}
 
 	if !isUnique {
-		return nil
+		return 0, nil
 	}
 
 	//Log.Infof("New meme %v", meme)
 
+	return s.insertMeme(ctx, meme, hash)
+}
+
+//exportMemes returns all memes with hashes of their pictures
+func (s *Storage) exportMemes() ([]ExportedMeme, error) {
+	res := []ExportedMeme{}
+	rows, err := s.DB.Query("SELECT m.*, h.hash FROM memes as m LEFT JOIN meme_hashes as h on h.meme_id == m.id ORDER BY m.id")
+	if err != nil {
+		return res, fmt.Errorf("Cannot get memes for export. Reason %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash sql.NullString
+		meme, err := scanMeme(rows, &hash)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, ExportedMeme{Meme: meme, Hash: hash.String})
+	}
+	return res, rows.Err()
+}
+
+//importMeme adds exported meme. Meme without hash is checked for collision like fetched one.
+func (s *Storage) importMeme(ctx context.Context, meme ExportedMeme, distance int) (int, error) {
+	if meme.Hash == "" {
+		return s.addMeme(ctx, meme.Meme, distance)
+	}
+	isExist, err := s.isMemeExists(ctx, meme.MemeId, meme.Public, meme.Platform)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot check is meme exist. Reason %s", err)
+	}
+	if isExist {
+		return 0, nil
+	}
+	return s.insertMeme(ctx, meme.Meme, meme.Hash)
+}
+
+//insertMeme saves meme with hash of its pictures in one transaction, so meme is never left without hash
+func (s *Storage) insertMeme(ctx context.Context, meme Meme, hash string) (int, error) {
 	pictures, err := json.Marshal(meme.Pictures)
 	if err != nil {
-		return fmt.Errorf("Cannot marshal meme.Pictures. Reason %s", err)
+		return 0, fmt.Errorf("Cannot marshal meme.Pictures. Reason %s", err)
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot begin transaction. Reason %s", err)
 	}
+	defer tx.Rollback()
 
-	res, err := s.DB.Exec("INSERT OR REPLACE INTO memes (memeid, public, platform, pictures, description, likes, reposts, views, comments, time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		meme.MemeId, meme.Public, meme.Platform, pictures, meme.Description, meme.Likes, meme.Reposts, meme.Views, meme.Comments, meme.Time.Format(ISO8601))
+	res, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO memes (memeid, public, platform, pictures, description, likes, reposts, views, comments, time, author, link) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		meme.MemeId, meme.Public, meme.Platform, pictures, meme.Description, meme.Likes, meme.Reposts, meme.Views, meme.Comments, meme.Time.Format(ISO8601), meme.Author, meme.Link)
 	if err != nil {
-		return fmt.Errorf("Cannot insert meme %v. Reason %s", meme, err)
+		return 0, fmt.Errorf("Cannot insert meme %v. Reason %s", meme, err)
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		return fmt.Errorf("Cannot get last insert id. Reason %s", err)
+		return 0, fmt.Errorf("Cannot get last insert id. Reason %s", err)
 	}
 
-	_, err = s.DB.Exec("INSERT OR REPLACE INTO meme_hashes (meme_id, hash) VALUES(?, ?)", id, hash)
+	_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO meme_hashes (meme_id, hash) VALUES(?, ?)", id, hash)
 	if err != nil {
-		return fmt.Errorf("Cannot add hash to mem_hashes table. Reason %s", err)
+		return 0, fmt.Errorf("Cannot add hash to mem_hashes table. Reason %s", err)
 	}
 
-	return nil
+	meme.Id = int(id)
+	err = s.indexMeme(ctx, tx, &meme)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("Cannot commit meme %v. Reason %s", meme, err)
+	}
+	return int(id), nil
 }
 
 func (s *Storage) parseGetMemesAnswer(rows *sql.Rows) ([]Meme, error) {
 	res := []Meme{}
-	var err error
 	for rows.Next() {
-		var (
-			id                                                 int
-			memeid, public, platform, picturesStr, description string
-			likes, reposts, views, comments                    int
-			timeStr                                            string
-		)
-		err = rows.Scan(&id, &memeid, &public, &platform, &picturesStr, &description, &likes, &reposts, &views, &comments, &timeStr)
+		meme, err := scanMeme(rows)
 		if err != nil {
-			return res, fmt.Errorf("Cannot scan from row. Reason %s", err)
+			return res, err
 		}
+		res = append(res, meme)
+	}
+	return res, nil
 
-		pictures := []string{}
-		err = json.Unmarshal([]byte(picturesStr), &pictures)
-		if err != nil {
-			return res, fmt.Errorf("Cannot unmarshal pictures for meme %d. Reason %s", id, err)
-		}
-		t, err := time.Parse(ISO8601, timeStr)
-		if err != nil {
-			return res, fmt.Errorf("Cannot parse time for meme %d. Reason %s", id, err)
-		}
+}
 
-		res = append(res, Meme{
-			Id:          id,
-			MemeId:      memeid,
-			Public:      public,
-			Platform:    platform,
-			Pictures:    pictures,
-			Description: description,
-			Likes:       likes,
-			Reposts:     reposts,
-			Views:       views,
-			Comments:    comments,
-			Time:        t,
-		})
+//scanMeme scans columns of memes table from row, columns selected after them are scanned to extra
+func scanMeme(rows *sql.Rows, extra ...interface{}) (Meme, error) {
+	var (
+		id                                                 int
+		memeid, public, platform, picturesStr, description string
+		likes, reposts, views, comments                    int
+		timeStr                                            string
+		author, link                                       sql.NullString
+	)
+	dest := []interface{}{&id, &memeid, &public, &platform, &picturesStr, &description, &likes, &reposts, &views, &comments, &timeStr, &author, &link}
+	err := rows.Scan(append(dest, extra...)...)
+	if err != nil {
+		return Meme{}, fmt.Errorf("Cannot scan from row. Reason %s", err)
 	}
-	return res, nil
 
+	pictures := []string{}
+	err = json.Unmarshal([]byte(picturesStr), &pictures)
+	if err != nil {
+		return Meme{}, fmt.Errorf("Cannot unmarshal pictures for meme %d. Reason %s", id, err)
+	}
+	t, err := time.Parse(ISO8601, timeStr)
+	if err != nil {
+		return Meme{}, fmt.Errorf("Cannot parse time for meme %d. Reason %s", id, err)
+	}
+
+	return Meme{
+		Id:          id,
+		MemeId:      memeid,
+		Public:      public,
+		Platform:    platform,
+		Pictures:    pictures,
+		Description: description,
+		Likes:       likes,
+		Reposts:     reposts,
+		Views:       views,
+		Comments:    comments,
+		Time:        t,
+		Author:      author.String,
+		Link:        link.String,
+	}, nil
 }
 
-func (s *Storage) MarkMemeShown(chatId int64, msgId int, memeid int) error {
-	_, err := s.DB.Exec("INSERT OR REPLACE INTO shown_memes (meme_id, chat_id, msg_id) VALUES (?, ?, ?)", memeid, chatId, msgId)
+//MarkMemeShown records posted meme. Arm is empty if slot is not part of experiment.
+func (s *Storage) MarkMemeShown(chatId int64, msgId int, memeid int, scorer, arm string) error {
+	_, err := s.DB.Exec("INSERT OR REPLACE INTO shown_memes (meme_id, chat_id, msg_id, time, scorer, arm) VALUES (?, ?, ?, ?, ?, ?)",
+		memeid, chatId, msgId, time.Now().Format(ISO8601), scorer, sql.NullString{String: arm, Valid: arm != ""})
 	if err != nil {
 		return fmt.Errorf("Cannot mark meme as shown. Reason %s", err)
 	}
@@ -387,10 +666,15 @@ func (s *Storage) GetMemes(from time.Time) ([]Meme, error) {
 	return s.parseGetMemesAnswer(rows)
 }
 
+//GetUnshownMemes returns memes for scoring. Submitted memes are posted only after moderation.
 func (s *Storage) GetUnshownMemes(chatId int64, from time.Time) ([]Meme, error) {
-	rows, err := s.DB.Query(`select * from memes as m where time > ? and EXISTS(
+	rows, err := s.DB.Query(`select * from memes as m where time > ? and platform != ? and EXISTS(
 	select 1 from shown_memes as sm where m.id == sm.meme_id and sm.chat_id == ?
-) == 0`, from.Format(ISO8601), chatId)
+) == 0 and EXISTS(
+	select 1 from banned_memes as bm where m.id == bm.meme_id
+) == 0 and EXISTS(
+	select 1 from disabled_publics as dp where m.platform == dp.platform and m.public == dp.public
+) == 0`, from.Format(ISO8601), PlatformSubmission, chatId)
 	if err != nil {
 		return []Meme{}, fmt.Errorf("Cannot get memes. Reason %s", err)
 	}
@@ -399,15 +683,18 @@ func (s *Storage) GetUnshownMemes(chatId int64, from time.Time) ([]Meme, error)
 	return s.parseGetMemesAnswer(rows)
 }
 
-func (s *Storage) Dump() error {
-	Log.Infof("Dumping storage...")
+func (s *Storage) Dump(scorer Scorer) error {
+	s.log.Infof("Dumping storage...")
 	memes, err := s.GetMemes(time.Unix(0, 0))
 	if err != nil {
 		return err
 	}
 
+	now := time.Now()
+
 	type MemeEx struct {
 		Meme
+		Scorer           string
 		KekIndex         float64
 		TimeCoeff        float64
 		GroupRating      float64
@@ -417,17 +704,19 @@ func (s *Storage) Dump() error {
 		KekScore         float64
 	}
 
+	coeffs := s.Coeffs()
 	res := []MemeEx{}
 	for _, meme := range memes {
 		res = append(res, MemeEx{
 			Meme:             meme,
+			Scorer:           scorer.Name(),
 			KekIndex:         meme.calculateKekIndex(),
-			TimeCoeff:        meme.calculateTimeCoeff(),
-			GroupRating:      meme.calculateGroupRating(),
-			GroupActivity:    meme.calculateGroupActivity(),
-			PlatformRating:   meme.calculatePlatformRating(),
-			PlatformActivity: meme.calculatePlatformActivity(),
-			KekScore:         meme.СalculateKekScore(),
+			TimeCoeff:        meme.calculateTimeCoeff(coeffs, now),
+			GroupRating:      meme.calculateGroupRating(coeffs),
+			GroupActivity:    meme.calculateGroupActivity(coeffs),
+			PlatformRating:   meme.calculatePlatformRating(coeffs),
+			PlatformActivity: meme.calculatePlatformActivity(coeffs),
+			KekScore:         scorer.Score(&meme, coeffs, now),
 		})
 	}
 
@@ -453,15 +742,28 @@ func (s *Storage) Dump() error {
 	return nil
 }
 
-func NewStorage(dbname string) (*Storage, error) {
+//Close closes database, it is called when all writers are stopped
+func (s *Storage) Close() error {
+	err := s.DB.Close()
+	if err != nil {
+		return fmt.Errorf("Cannot close db. Reason %s", err)
+	}
+	return nil
+}
+
+func NewStorage(dbname string, logger *log.Logger) (*Storage, error) {
 	db, err := sql.Open("sqlite3", dbname)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot open sqlite. Reason %s", err)
 	}
 
 	s := Storage{
-		DB:           db,
-		GroupRatings: nil,
+		DB:         db,
+		log:        logger,
+		publicName: func(m *Meme) string { return m.Public },
+		fileURL: func(fileId string) (string, error) {
+			return "", fmt.Errorf("Cannot get link of file %s without bot", fileId)
+		},
 	}
 
 	return &s, nil
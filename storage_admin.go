@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+//Summary is short statistics for /stats command
+type Summary struct {
+	Memes       int
+	MemesLast24 int
+	Posted      int
+	Likes       int
+	Dislikes    int
+	Banned      int
+	Disabled    int
+}
+
+//SkipMeme marks meme as shown in chat without posting it
+func (s *Storage) SkipMeme(chatId int64, memeId int) error {
+	return s.MarkMemeShown(chatId, 0, memeId, "", "")
+}
+
+//BanMeme excludes meme from posting in all chats
+func (s *Storage) BanMeme(memeId int) error {
+	_, err := s.DB.Exec("INSERT OR REPLACE INTO banned_memes (meme_id) VALUES (?)", memeId)
+	if err != nil {
+		return fmt.Errorf("Cannot ban meme %d. Reason %s", memeId, err)
+	}
+	return nil
+}
+
+func (s *Storage) SetPublicDisabled(platform, public string, disabled bool) error {
+	var err error
+	if disabled {
+		_, err = s.DB.Exec("INSERT OR REPLACE INTO disabled_publics (platform, public) VALUES (?, ?)", platform, public)
+	} else {
+		_, err = s.DB.Exec("DELETE FROM disabled_publics WHERE platform = ? and public = ?", platform, public)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot change state of public %s/%s. Reason %s", platform, public, err)
+	}
+	return nil
+}
+
+func (s *Storage) IsPublicDisabled(platform, public string) (bool, error) {
+	exist := 0
+	err := s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM disabled_publics WHERE platform = ? and public = ?)", platform, public).Scan(&exist)
+	if err != nil {
+		return false, fmt.Errorf("Cannot check is public %s/%s disabled. Reason %s", platform, public, err)
+	}
+	return exist == 1, nil
+}
+
+func (s *Storage) GetSummary(chatId int64) (Summary, error) {
+	res := Summary{}
+	err := s.DB.QueryRow(`select
+	(select count(*) from memes),
+	(select count(*) from memes where time > ?),
+	(select count(*) from shown_memes where chat_id = ? and msg_id != 0),
+	(select count(*) from chat_metadata where chat_id = ? and btn_id = 0),
+	(select count(*) from chat_metadata where chat_id = ? and btn_id = 1),
+	(select count(*) from banned_memes),
+	(select count(*) from disabled_publics)`,
+		time.Now().Add(-time.Duration(24)*time.Hour).Format(ISO8601), chatId, chatId, chatId).Scan(
+		&res.Memes, &res.MemesLast24, &res.Posted, &res.Likes, &res.Dislikes, &res.Banned, &res.Disabled)
+	if err != nil {
+		return res, fmt.Errorf("Cannot get summary. Reason %s", err)
+	}
+	return res, nil
+}
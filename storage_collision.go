@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"image"
 	_ "image/jpeg"
@@ -10,14 +12,19 @@ import (
 	"github.com/corona10/goimagehash"
 )
 
+//MemeHash is hash of meme pictures. MemeId is 0 for memes removed by retention, their description is stored with hash.
 type MemeHash struct {
-	MemeId int
-	Hash   *goimagehash.ImageHash
+	MemeId      int
+	Hash        *goimagehash.ImageHash
+	Description string
 }
 
-func getImageHash(url string) (string, error) {
-
-	resp, err := http.Get(url)
+func getImageHash(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("Cannot create request for image %s. Reason %s", url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("Cannot download image %s. Reason %s", url, err)
 	}
@@ -33,10 +40,14 @@ func getImageHash(url string) (string, error) {
 	return hash.ToString(), nil
 }
 
-func (m *Meme) getHash() (*goimagehash.ImageHash, error) {
+func (s *Storage) getHash(ctx context.Context, m *Meme) (*goimagehash.ImageHash, error) {
 	res := ""
-	for _, url := range m.Pictures {
-		hash, err := getImageHash(url)
+	for _, picture := range m.Pictures {
+		url, err := s.hashURL(m, picture)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get hash from meme. Reason %s", err)
+		}
+		hash, err := getImageHash(ctx, url)
 		if err != nil {
 			return nil, fmt.Errorf("Cannot get hash from meme. Reason %s", err)
 		}
@@ -49,10 +60,11 @@ func (m *Meme) getHash() (*goimagehash.ImageHash, error) {
 	return hash, nil
 }
 
-func (s *Storage) isUnique(meme *Meme) (bool, string, error) {
-	rows, err := s.DB.Query("SELECT meme_id, hash FROM meme_hashes")
+//getHashes returns hashes of all memes including ones removed by retention
+func (s *Storage) getHashes() ([]MemeHash, error) {
+	rows, err := s.DB.Query("SELECT meme_id, hash, '' FROM meme_hashes UNION ALL SELECT 0, hash, description FROM dedup_hashes")
 	if err != nil {
-		return false, "", fmt.Errorf("Cannot select hashes for meme %v. Reason %s", meme, err)
+		return nil, fmt.Errorf("Cannot select hashes. Reason %s", err)
 	}
 	defer rows.Close()
 
@@ -61,21 +73,32 @@ func (s *Storage) isUnique(meme *Meme) (bool, string, error) {
 	for rows.Next() {
 		var memeid int
 		var hash string
-		err := rows.Scan(&memeid, &hash)
+		var description sql.NullString
+		err := rows.Scan(&memeid, &hash, &description)
 		if err != nil {
-			return false, "", fmt.Errorf("Cannot scan image hash from db. Reason %s", err)
+			return nil, fmt.Errorf("Cannot scan image hash from db. Reason %s", err)
 		}
 		imgHash, err := goimagehash.ImageHashFromString(hash)
 		if err != nil {
-			Log.Errorf("Cannot parse hash for meme with id %d. Reason %s", memeid, err)
+			s.log.Errorf("Cannot parse hash for meme with id %d. Reason %s", memeid, err)
+			continue
 		}
 		hashes = append(hashes, MemeHash{
-			MemeId: memeid,
-			Hash:   imgHash,
+			MemeId:      memeid,
+			Hash:        imgHash,
+			Description: description.String,
 		})
 	}
+	return hashes, nil
+}
+
+func (s *Storage) isUnique(ctx context.Context, meme *Meme, distance int) (bool, string, error) {
+	hashes, err := s.getHashes()
+	if err != nil {
+		return false, "", fmt.Errorf("Cannot check meme %v. Reason %s", meme, err)
+	}
 
-	memeHash, err := meme.getHash()
+	memeHash, err := s.getHash(ctx, meme)
 	if err != nil {
 		return false, "", fmt.Errorf("Cannot get hash for meme. Reason %s", err)
 	}
@@ -83,17 +106,20 @@ func (s *Storage) isUnique(meme *Meme) (bool, string, error) {
 	for _, hash := range hashes {
 		dist, _ := hash.Hash.Distance(memeHash)
 
-		if dist <= Config.Collision.Distance {
-			m, err := s.GetMemeById(hash.MemeId)
-			if err != nil {
-				return false, "", fmt.Errorf("Cannot get meme associated with hash %v. Reason %s", hash, err)
+		if dist <= distance {
+			m := &Meme{Description: hash.Description}
+			if hash.MemeId != 0 {
+				m, err = s.GetMemeById(hash.MemeId)
+				if err != nil {
+					return false, "", fmt.Errorf("Cannot get meme associated with hash %v. Reason %s", hash, err)
+				}
 			}
 
 			if m.Description == meme.Description {
-				Log.Infof("Meme %v is not unique. Same meme is %v. Hashes %s %s", meme, m, memeHash, hash.Hash)
+				s.log.Infof("Meme %v is not unique. Same meme is %v. Hashes %s %s", meme, m, memeHash.ToString(), hash.Hash.ToString())
 				return false, memeHash.ToString(), nil
 			} else {
-				Log.Infof("Pictures in meme %v is not unique to %v, but text is different", meme, m)
+				s.log.Infof("Pictures in meme %v is not unique to %v, but text is different", meme, m)
 			}
 		}
 	}
@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"time"
 )
 
 func (s *Storage) MakeAction(platform string, chatId int64, messageId, userId, btnId int) error {
@@ -65,6 +66,7 @@ type MemeStat struct {
 	Public     string
 	Platform   string
 	Pictures   string
+	Posted     time.Time
 	Likes      int
 	Dislikes   int
 	KekIndex   float64
@@ -72,62 +74,105 @@ type MemeStat struct {
 	GroupCoeff float64
 }
 
-func (s *Storage) getStatistics(chatId int64) ([]MemeStat, error) {
-	res := []MemeStat{}
-	rows, err := s.DB.Query(`select meme_id, msg_id from shown_memes where msg_id != 0 and chat_id = ?`, chatId)
+type ShownMeme struct {
+	MemeId int
+	MsgId  int
+	//Time is zero for memes shown before posting time was recorded
+	Time time.Time
+}
+
+//getShownMemes returns posted memes for chat in order they were posted
+func (s *Storage) getShownMemes(chatId int64) ([]ShownMeme, error) {
+	res := []ShownMeme{}
+	rows, err := s.DB.Query(`select meme_id, msg_id, time from shown_memes where msg_id != 0 and chat_id = ? order by rowid`, chatId)
 	if err != nil {
 		return res, fmt.Errorf("Cannot get shown_memes for chat %d. Reason %s", chatId, err)
 	}
-
-	type ShownMeme struct {
-		MemeId int
-		MsgId  int
-	}
-
-	shownmemes := []ShownMeme{}
+	defer rows.Close()
 
 	for rows.Next() {
 		var (
 			memeid, msgid int
+			timeStr       sql.NullString
 		)
-		err = rows.Scan(&memeid, &msgid)
+		err = rows.Scan(&memeid, &msgid, &timeStr)
 		if err != nil {
 			return res, fmt.Errorf("Cannot scan values from db. Reason %s", err)
 		}
-		shownmemes = append(shownmemes, ShownMeme{
+		smeme := ShownMeme{
 			MemeId: memeid,
 			MsgId:  msgid,
-		})
+		}
+		if timeStr.Valid {
+			smeme.Time, err = time.Parse(ISO8601, timeStr.String)
+			if err != nil {
+				return res, fmt.Errorf("Cannot parse time for shown meme %d. Reason %s", memeid, err)
+			}
+		}
+		res = append(res, smeme)
 	}
-	rows.Close()
 
-	for _, smeme := range shownmemes {
-		var likes, dislikes int
-		err := s.DB.QueryRow(`select t1.likes, t2.dislikes from
+	return res, nil
+}
+
+func (s *Storage) getVotes(chatId int64, msgId int) (int, int, error) {
+	var likes, dislikes int
+	err := s.DB.QueryRow(`select t1.likes, t2.dislikes from
 			(select count(*) as likes from chat_metadata where chat_id=? and msg_id = ? and btn_id=0) as t1
 			join
-			(select count(*) as dislikes from chat_metadata where chat_id=? and msg_id = ? and btn_id=1) as t2;`, chatId, smeme.MsgId, chatId, smeme.MsgId).Scan(&likes, &dislikes)
+			(select count(*) as dislikes from chat_metadata where chat_id=? and msg_id = ? and btn_id=1) as t2;`, chatId, msgId, chatId, msgId).Scan(&likes, &dislikes)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Cannot get counter for message %d. Reason %s", msgId, err)
+	}
+	return likes, dislikes, nil
+}
+
+//getStatistics returns posted memes of chat with votes under them
+func (s *Storage) getStatistics(chatId int64) ([]MemeStat, error) {
+	res := []MemeStat{}
+	rows, err := s.DB.Query(`select m.*, sm.time,
+(select count(*) from chat_metadata as cm where cm.chat_id == sm.chat_id and cm.msg_id == sm.msg_id and cm.btn_id == 0),
+(select count(*) from chat_metadata as cm where cm.chat_id == sm.chat_id and cm.msg_id == sm.msg_id and cm.btn_id == 1)
+from shown_memes as sm join memes as m on m.id == sm.meme_id
+where sm.msg_id != 0 and sm.chat_id = ? order by sm.rowid`, chatId)
+	if err != nil {
+		return res, fmt.Errorf("Cannot get statistics for chat %d. Reason %s", chatId, err)
+	}
+	defer rows.Close()
+
+	coeffs := s.Coeffs()
+	now := time.Now()
+	for rows.Next() {
+		var (
+			shownStr        sql.NullString
+			likes, dislikes int
+		)
+		meme, err := scanMeme(rows, &shownStr, &likes, &dislikes)
 		if err != nil {
-			return res, fmt.Errorf("Cannot get counter for message %d. Reason %s", smeme.MsgId, err)
+			return res, err
 		}
 
-		meme, err := s.GetMemeById(smeme.MemeId)
-		if err != nil {
-			return res, fmt.Errorf("Cannot get meme %d. Reason %s", smeme.MemeId, err)
+		posted := meme.Time
+		if shownStr.Valid {
+			posted, err = time.Parse(ISO8601, shownStr.String)
+			if err != nil {
+				return res, fmt.Errorf("Cannot parse time for shown meme %d. Reason %s", meme.Id, err)
+			}
 		}
 
 		res = append(res, MemeStat{
 			MemeId:     meme.MemeId,
+			Posted:     posted,
 			Public:     meme.Public,
 			Platform:   meme.Platform,
 			Pictures:   fmt.Sprintf("%v", meme.Pictures),
 			Likes:      likes,
 			Dislikes:   dislikes,
 			KekIndex:   meme.calculateKekIndex(),
-			TimeCoeff:  meme.calculateTimeCoeff(),
-			GroupCoeff: meme.calculateGroupRating(),
+			TimeCoeff:  meme.calculateTimeCoeff(coeffs, now),
+			GroupCoeff: meme.calculateGroupRating(coeffs),
 		})
 	}
 
-	return res, nil
+	return res, rows.Err()
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+//searchFilter hides banned memes and submitted memes which were not posted
+const searchFilter = `EXISTS(
+	select 1 from banned_memes as bm where m.id == bm.meme_id
+) == 0 and (m.platform != ? or EXISTS(
+	select 1 from shown_memes as sm where m.id == sm.meme_id and sm.msg_id != 0
+))`
+
+//initSearch creates full-text index. Sqlite has to be built with fts5 tag,
+//without it search falls back to LIKE over descriptions.
+func (s *Storage) initSearch() error {
+	_, err := s.DB.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS memes_fts USING fts5(description, ocr, public)`)
+	if err != nil {
+		s.log.Errorf("Cannot create full-text index, search is slow. Reason %s", err)
+		s.fts = false
+		return nil
+	}
+	s.fts = true
+
+	rows, err := s.DB.Query("SELECT id FROM memes WHERE id NOT IN (SELECT rowid FROM memes_fts)")
+	if err != nil {
+		return fmt.Errorf("Cannot get memes without index. Reason %s", err)
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("Cannot scan from row. Reason %s", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if len(ids) > 0 {
+		s.log.Infof("Indexing %d memes for search", len(ids))
+	}
+	for _, id := range ids {
+		meme, err := s.GetMemeById(id)
+		if err != nil {
+			return err
+		}
+		err = s.indexMeme(context.Background(), s.DB, meme)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//indexMeme adds meme to full-text index. Submitted memes are indexed without author.
+func (s *Storage) indexMeme(ctx context.Context, db execer, m *Meme) error {
+	if !s.fts {
+		return nil
+	}
+	public := ""
+	if m.Platform != PlatformSubmission {
+		public = s.publicName(m)
+	}
+	_, err := db.ExecContext(ctx, "INSERT OR REPLACE INTO memes_fts (rowid, description, ocr, public) VALUES (?, ?, '', ?)",
+		m.Id, m.Description, public)
+	if err != nil {
+		return fmt.Errorf("Cannot index meme %d. Reason %s", m.Id, err)
+	}
+	return nil
+}
+
+//ftsQuery makes prefix query from user input, every word is quoted so input cannot break query syntax
+func ftsQuery(query string) string {
+	words := []string{}
+	for _, word := range strings.Fields(query) {
+		words = append(words, fmt.Sprintf(`"%s"*`, strings.Replace(word, `"`, `""`, -1)))
+	}
+	return strings.Join(words, " ")
+}
+
+//SearchMemes returns up to limit memes matching query
+func (s *Storage) SearchMemes(query string, limit int) ([]Meme, error) {
+	if strings.TrimSpace(query) == "" {
+		return []Meme{}, nil
+	}
+
+	if s.fts {
+		rows, err := s.DB.Query(fmt.Sprintf(`select m.* from memes as m join memes_fts as f on f.rowid == m.id
+where memes_fts MATCH ? and %s order by f.rank limit ?`, searchFilter), ftsQuery(query), PlatformSubmission, limit)
+		if err != nil {
+			return []Meme{}, fmt.Errorf("Cannot search memes. Reason %s", err)
+		}
+		defer rows.Close()
+		return s.parseGetMemesAnswer(rows)
+	}
+
+	rows, err := s.DB.Query(fmt.Sprintf(`select m.* from memes as m
+where (m.description like ? or m.public like ?) and %s limit ?`, searchFilter),
+		"%"+query+"%", "%"+query+"%", PlatformSubmission, limit)
+	if err != nil {
+		return []Meme{}, fmt.Errorf("Cannot search memes. Reason %s", err)
+	}
+	defer rows.Close()
+	return s.parseGetMemesAnswer(rows)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/toby3d/telegram"
+)
+
+const (
+	PlatformSubmission = "submission"
+
+	//videoPrefix marks video in pictures of submitted meme: video:<file id>:<thumbnail file id>
+	videoPrefix = "video:"
+
+	//albumTimeout is how long bot waits for the rest of album
+	albumTimeout = 2 * time.Second
+)
+
+//SubmissionConfig is [submission] section. Window is in minutes.
+type SubmissionConfig struct {
+	Enabled bool
+	Limit   int
+	Window  int
+}
+
+func (c *SubmissionConfig) limit() int {
+	if c.Limit <= 0 {
+		return 5
+	}
+	return c.Limit
+}
+
+func (c *SubmissionConfig) window() time.Duration {
+	if c.Window <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.Window) * time.Minute
+}
+
+func isVideo(path string) bool {
+	return strings.HasPrefix(path, videoPrefix)
+}
+
+//videoFileId returns file id of video and its thumbnail
+func videoFileId(path string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, videoPrefix), ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+//fileURL returns download link of file stored on telegram servers
+func (b *TelegramBot) fileURL(fileId string) (string, error) {
+	file, err := b.bot.GetFile(fileId)
+	if err != nil {
+		return "", fmt.Errorf("Cannot get file %s. Reason %s", fileId, err)
+	}
+	link := b.bot.NewFileURL(file.FilePath)
+	if link == nil {
+		return "", fmt.Errorf("Cannot get link of file %s", fileId)
+	}
+	return link.String(), nil
+}
+
+//hashURL returns address of image which is used for collision check of picture.
+//Submitted memes are stored as telegram file ids, videos are checked by thumbnail.
+func (s *Storage) hashURL(m *Meme, picture string) (string, error) {
+	if m.Platform != PlatformSubmission {
+		return picture, nil
+	}
+	fileId := picture
+	if isVideo(picture) {
+		_, fileId = videoFileId(picture)
+		if fileId == "" {
+			return "", fmt.Errorf("Video %s has no thumbnail", picture)
+		}
+	}
+	return s.fileURL(fileId)
+}
+
+func (s *Storage) addSubmission(memeId, userId int, name string) error {
+	_, err := s.DB.Exec("INSERT INTO submissions (meme_id, user_id, name, created) VALUES (?, ?, ?, ?)",
+		memeId, userId, name, time.Now().Format(ISO8601))
+	if err != nil {
+		return fmt.Errorf("Cannot add submission of meme %d. Reason %s", memeId, err)
+	}
+	return nil
+}
+
+func (s *Storage) countSubmissions(userId int, from time.Time) (int, error) {
+	count := 0
+	err := s.DB.QueryRow("SELECT count(*) FROM submissions WHERE user_id = ? and created > ?",
+		userId, from.Format(ISO8601)).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot count submissions of user %d. Reason %s", userId, err)
+	}
+	return count, nil
+}
+
+//getSubmitterName returns name of user who sent meme
+func (s *Storage) getSubmitterName(memeId int) (string, error) {
+	name := ""
+	err := s.DB.QueryRow("SELECT name FROM submissions WHERE meme_id = ?", memeId).Scan(&name)
+	if err != nil {
+		return "", fmt.Errorf("Cannot get submitter of meme %d. Reason %s", memeId, err)
+	}
+	return name, nil
+}
+
+func submitterName(user *telegram.User) string {
+	if user.Username != "" {
+		return "@" + user.Username
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s %s", user.FirstName, user.LastName))
+}
+
+//submissionMedia returns picture of message as it is stored in meme
+func submissionMedia(msg *telegram.Message) string {
+	if msg.IsVideo() {
+		thumb := ""
+		if msg.Video.Thumb != nil {
+			thumb = msg.Video.Thumb.FileID
+		}
+		return fmt.Sprintf("%s%s:%s", videoPrefix, msg.Video.FileID, thumb)
+	}
+	//last size is the biggest one
+	return msg.Photo[len(msg.Photo)-1].FileID
+}
+
+//albumCollector joins messages of one album to one submission
+type albumCollector struct {
+	sync.Mutex
+	albums map[string][]*telegram.Message
+}
+
+func newAlbumCollector() *albumCollector {
+	return &albumCollector{albums: map[string][]*telegram.Message{}}
+}
+
+//handleSubmission accepts photo, video or part of album sent to bot in private chat
+func (a *App) handleSubmission(msg *telegram.Message) {
+	if msg.MediaGroupID == "" {
+		a.submit([]*telegram.Message{msg})
+		return
+	}
+
+	a.albums.Lock()
+	defer a.albums.Unlock()
+	msgs, ok := a.albums.albums[msg.MediaGroupID]
+	a.albums.albums[msg.MediaGroupID] = append(msgs, msg)
+	if ok {
+		return
+	}
+	time.AfterFunc(albumTimeout, func() {
+		if !a.tasks.start() {
+			return
+		}
+		defer a.tasks.done()
+		a.albums.Lock()
+		msgs := a.albums.albums[msg.MediaGroupID]
+		delete(a.albums.albums, msg.MediaGroupID)
+		a.albums.Unlock()
+		a.submit(msgs)
+	})
+}
+
+func (a *App) submit(msgs []*telegram.Message) {
+	first := msgs[0]
+	reply := func(text string) {
+		err := a.Bot.SendTextTo(first.Chat.ID, text)
+		if err != nil {
+			a.Log.Errorf("Cannot answer submitter. Reason %s", err)
+		}
+	}
+
+	count, err := a.Storage.countSubmissions(first.From.ID, time.Now().Add(-a.Config().Submission.window()))
+	if err != nil {
+		a.Log.Errorf("%s", err)
+		reply("Не получилось принять мем, попробуй позже")
+		return
+	}
+	if count >= a.Config().Submission.limit() {
+		reply("Слишком много мемов, попробуй позже")
+		return
+	}
+
+	name := submitterName(first.From)
+	meme := Meme{
+		MemeId:   strconv.Itoa(first.ID),
+		Public:   strconv.Itoa(first.From.ID),
+		Platform: PlatformSubmission,
+		Time:     first.Time(),
+		Author:   name,
+	}
+	for _, msg := range msgs {
+		meme.Pictures = append(meme.Pictures, submissionMedia(msg))
+		if meme.Description == "" {
+			meme.Description = msg.Caption
+		}
+	}
+
+	//worker finishes update it got even during shutdown, so submission is not cancelled
+	id, err := a.Storage.addMeme(context.Background(), meme, a.Config().Collision.Distance)
+	if err != nil {
+		a.Log.Errorf("Cannot add submitted meme. Reason %s", err)
+		reply("Не получилось принять мем, попробуй позже")
+		return
+	}
+	if id == 0 {
+		reply("Такой мем уже был")
+		return
+	}
+	meme.Id = id
+
+	err = a.Storage.addSubmission(id, first.From.ID, name)
+	if err != nil {
+		a.Log.Errorf("%s", err)
+	}
+
+	chatId := a.Config().Moderation.chatId(a.Config().TelegramBot.ChatIdDebug)
+	msgid, err := a.Bot.SendPhotoWithKeyboard(chatId, meme.Pictures, meme.Description,
+		fmt.Sprintf("#%d прислал %s", id, name), moderationKeyboard(id))
+	if err != nil {
+		a.Log.Errorf("Cannot send submitted meme %d to moderation. Reason %s", id, err)
+	} else {
+		err = a.Storage.AddModerationCandidate(id, chatId, msgid)
+		if err != nil {
+			a.Log.Errorf("%s", err)
+		}
+	}
+
+	reply("Спасибо! Мем отправлен модераторам")
+}
+
+//notifySubmitter tells user that his meme is posted
+func (a *App) notifySubmitter(m *Meme) {
+	userId, err := strconv.ParseInt(m.Public, 10, 64)
+	if err != nil {
+		a.Log.Errorf("Wrong submitter id %s of meme %d", m.Public, m.Id)
+		return
+	}
+	err = a.Bot.SendTextTo(userId, "Твой мем опубликован, спасибо!")
+	if err != nil {
+		a.Log.Errorf("Cannot notify submitter of meme %d. Reason %s", m.Id, err)
+	}
+}
+
+//enqueueSubmission adds approved submitted meme to publish queue
+func (a *App) enqueueSubmission(memeId int) error {
+	meme, err := a.Storage.GetMemeById(memeId)
+	if err != nil {
+		return err
+	}
+	if meme.Platform != PlatformSubmission {
+		return nil
+	}
+	_, err = a.Storage.Enqueue(a.Config().TelegramBot.ChatId, memeId, time.Time{})
+	return err
+}
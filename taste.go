@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gitlab.com/toby3d/telegram"
+)
+
+//TasteProfile is preferences of one subscriber built from his button presses
+type TasteProfile struct {
+	UserId    int
+	Votes     int
+	Overall   Rating
+	Publics   map[string]Rating
+	Platforms map[string]Rating
+	Features  map[string]Rating
+	minVotes  float64
+}
+
+//memeFeatures are content features used in taste profile
+func memeFeatures(m *Meme) []string {
+	features := []string{}
+	if len(m.Pictures) > 1 {
+		features = append(features, "pictures:multi")
+	} else {
+		features = append(features, "pictures:single")
+	}
+	switch {
+	case len(m.Description) == 0:
+		features = append(features, "text:none")
+	case len([]rune(m.Description)) < MEDIA_CAPTION_SIZE:
+		features = append(features, "text:short")
+	default:
+		features = append(features, "text:long")
+	}
+	return features
+}
+
+func publicKey(m *Meme) string {
+	return fmt.Sprintf("%s/%s", m.Platform, m.Public)
+}
+
+func (s *Storage) GetTasteProfile(userId int, metric *MetricConfig) (*TasteProfile, error) {
+	type Counters struct {
+		Likes    float64
+		Dislikes float64
+	}
+
+	//memes are selected with votes, so profile is built by one query
+	rows, err := s.DB.Query(`select m.*, cm.btn_id from chat_metadata as cm
+	join shown_memes as sm on sm.chat_id = cm.chat_id and sm.msg_id = cm.msg_id
+	join memes as m on m.id = sm.meme_id
+	where cm.user_id = ?`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get votes of user %d. Reason %s", userId, err)
+	}
+
+	type Vote struct {
+		Meme  Meme
+		BtnId int
+	}
+	votes := []Vote{}
+	for rows.Next() {
+		vote := Vote{}
+		vote.Meme, err = scanMeme(rows, &vote.BtnId)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("Cannot scan vote. Reason %s", err)
+		}
+		votes = append(votes, vote)
+	}
+	rows.Close()
+
+	overall := Counters{}
+	publics := map[string]Counters{}
+	platforms := map[string]Counters{}
+	features := map[string]Counters{}
+	add := func(counters map[string]Counters, key string, liked bool) {
+		counter := counters[key]
+		if liked {
+			counter.Likes++
+		} else {
+			counter.Dislikes++
+		}
+		counters[key] = counter
+	}
+
+	for _, vote := range votes {
+		meme := &vote.Meme
+		liked := vote.BtnId == 0
+		if liked {
+			overall.Likes++
+		} else {
+			overall.Dislikes++
+		}
+		add(publics, publicKey(meme), liked)
+		add(platforms, meme.Platform, liked)
+		for _, feature := range memeFeatures(meme) {
+			add(features, feature, liked)
+		}
+	}
+
+	toRatings := func(counters map[string]Counters) map[string]Rating {
+		res := map[string]Rating{}
+		for key, counter := range counters {
+			res[key] = metric.Rating.newRating(counter.Likes, counter.Dislikes)
+		}
+		return res
+	}
+
+	return &TasteProfile{
+		UserId:    userId,
+		Votes:     len(votes),
+		Overall:   metric.Rating.newRating(overall.Likes, overall.Dislikes),
+		Publics:   toRatings(publics),
+		Platforms: toRatings(platforms),
+		Features:  toRatings(features),
+		minVotes:  metric.Taste.MinVotes,
+	}, nil
+}
+
+//affinity is how much user likes meme compared to his average like rate
+func (p *TasteProfile) affinity(m *Meme) float64 {
+	res := 1.0
+	relative := func(rating Rating, ok bool) {
+		if ok && p.Overall.Value > 0 {
+			res *= rating.Value / p.Overall.Value
+		}
+	}
+	rating, ok := p.Publics[publicKey(m)]
+	relative(rating, ok)
+	rating, ok = p.Platforms[m.Platform]
+	relative(rating, ok)
+	for _, feature := range memeFeatures(m) {
+		rating, ok = p.Features[feature]
+		relative(rating, ok)
+	}
+	return res
+}
+
+//weight is trust to profile. Users with few votes get global score.
+func (p *TasteProfile) weight() float64 {
+	minVotes := p.minVotes
+	if minVotes <= 0 {
+		minVotes = 20
+	}
+	return float64(p.Votes) / (float64(p.Votes) + minVotes)
+}
+
+//PersonalScorer adjusts global score with subscriber's taste
+type PersonalScorer struct {
+	base    Scorer
+	profile *TasteProfile
+}
+
+func NewPersonalScorer(base Scorer, profile *TasteProfile) *PersonalScorer {
+	return &PersonalScorer{
+		base:    base,
+		profile: profile,
+	}
+}
+
+func (s *PersonalScorer) Name() string {
+	return fmt.Sprintf("personal:%s", s.base.Name())
+}
+
+func (s *PersonalScorer) Score(m *Meme, c *Coeffs, at time.Time) float64 {
+	w := s.profile.weight()
+	return s.base.Score(m, c, at) * (1 - w + w*s.profile.affinity(m))
+}
+
+//sendPersonalMeme answers /mymeme with best unshown meme for user who asked
+func (a *App) sendPersonalMeme(msg *telegram.Message) error {
+	profile, err := a.Storage.GetTasteProfile(msg.From.ID, &a.Config().Metric)
+	if err != nil {
+		return fmt.Errorf("Cannot get taste profile. Reason %s", err)
+	}
+
+	memes, err := a.Storage.GetUnshownMemes(msg.Chat.ID, time.Now().Add(-time.Duration(24)*time.Hour))
+	if err != nil {
+		return fmt.Errorf("Cannot get memes. Reason %s", err)
+	}
+
+	posted, err := a.Storage.getShownMemes(a.Bot.ChatId)
+	if err != nil {
+		return err
+	}
+	shown := map[int]bool{}
+	for _, smeme := range posted {
+		shown[smeme.MemeId] = true
+	}
+
+	scorer := NewPersonalScorer(a.getScorer(a.Bot.ChatId), profile)
+	coeffs := a.Storage.Coeffs()
+	now := time.Now()
+	var best *Meme
+	bestScore := 0.0
+	for i := range memes {
+		if shown[memes[i].Id] {
+			continue
+		}
+		score := scorer.Score(&memes[i], coeffs, now)
+		if best == nil || score > bestScore {
+			best = &memes[i]
+			bestScore = score
+		}
+	}
+
+	if best == nil {
+		return a.Bot.SendTextTo(msg.Chat.ID, "Новых мемов пока нет, попробуй позже")
+	}
+
+	caption, err := a.Caption(msg.Chat.ID, "personal_caption", best, bestScore)
+	if err != nil {
+		return err
+	}
+
+	msgid, err := a.Bot.SendPhotoTo(msg.Chat.ID, best.Pictures, caption)
+	if err != nil {
+		return fmt.Errorf("Cannot send photo to telegram. Reason %s", err)
+	}
+
+	//meme is sent already, so user is not answered with error
+	err = a.Storage.MarkMemeShown(msg.Chat.ID, msgid, best.Id, scorer.Name(), "")
+	if err != nil {
+		a.Log.Errorf("Cannot mark personal meme %d shown. Reason %s", best.Id, err)
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/cjongseok/mtproto"
 	//"github.com/cjongseok/slog"
 	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
 )
 
 type Telegram struct {
@@ -19,11 +20,30 @@ type Telegram struct {
 	Port            int
 	LookingDuration int
 	LoadStep        int32
-	caller          mtproto.RPCaller
+	//Publics are titles of channels to read, all subscribed channels are read if it is empty
+	Publics []string
+	caller  mtproto.RPCaller
+	storage *Storage
+	log     *log.Logger
+	//serveAddress is where code for auth is recieved
+	serveAddress string
+}
+
+func (t *Telegram) isConfigured(ch TelegramChannel) bool {
+	if len(t.Publics) == 0 {
+		return true
+	}
+	for _, public := range t.Publics {
+		if public == ch.ChanName {
+			return true
+		}
+	}
+	return false
 }
 
 type TelegramChannel struct {
 	ChanName   string
+	Username   string
 	ChanId     int32
 	AccessHash int64
 }
@@ -38,16 +58,16 @@ func (t *Telegram) PrintDialogs() error {
 	}
 	switch dialogs := resp.GetValue().(type) {
 	case *mtproto.TypeMessagesDialogs_MessagesDialogs:
-		Log.Infof("Print dialogs: %v", dialogs.MessagesDialogs.String())
+		t.log.Infof("Print dialogs: %v", dialogs.MessagesDialogs.String())
 	case *mtproto.TypeMessagesDialogs_MessagesDialogsSlice:
-		Log.Infof("Print dialogs: %v", dialogs.MessagesDialogsSlice.String())
+		t.log.Infof("Print dialogs: %v", dialogs.MessagesDialogsSlice.String())
 	}
 
 	return nil
 }
 
 func (t *Telegram) PrintMessages(chanId int32, accessHash int64) error {
-	Log.Infof("MessagesGetHistory calling...")
+	t.log.Infof("MessagesGetHistory calling...")
 	resp, err := t.caller.MessagesGetHistory(context.Background(), &mtproto.ReqMessagesGetHistory{
 		Peer: &mtproto.TypeInputPeer{Value: &mtproto.TypeInputPeer_InputPeerChannel{
 			&mtproto.PredInputPeerChannel{
@@ -57,20 +77,20 @@ func (t *Telegram) PrintMessages(chanId int32, accessHash int64) error {
 		},
 		Limit: 10,
 	})
-	Log.Infof("MessagesGetHistory called")
+	t.log.Infof("MessagesGetHistory called")
 	if err != nil {
 		return fmt.Errorf("Cannot print messages. Reason %s", err)
 	}
 
 	switch messages := resp.GetValue().(type) {
 	case *mtproto.TypeMessagesMessages_MessagesMessages:
-		Log.Infof("Print messages: %v", messages)
+		t.log.Infof("Print messages: %v", messages)
 	case *mtproto.TypeMessagesMessages_MessagesMessagesSlice:
-		Log.Infof("Print messages: %v", messages)
+		t.log.Infof("Print messages: %v", messages)
 	case *mtproto.TypeMessagesMessages_MessagesChannelMessages:
-		Log.Infof("Print messages: %v", messages)
+		t.log.Infof("Print messages: %v", messages)
 	default:
-		Log.Infof("Unknown type for messages. %v", messages)
+		t.log.Infof("Unknown type for messages. %v", messages)
 	}
 
 	return nil
@@ -120,6 +140,7 @@ func (t *Telegram) getChannels() ([]TelegramChannel, error) {
 			result = append(result, TelegramChannel{
 				ChanId:     channel.GetId(),
 				ChanName:   channel.GetTitle(),
+				Username:   channel.GetUsername(),
 				AccessHash: channel.GetAccessHash(),
 			})
 		}
@@ -132,6 +153,7 @@ func (t *Telegram) getChannels() ([]TelegramChannel, error) {
 			result = append(result, TelegramChannel{
 				ChanId:     channel.GetId(),
 				ChanName:   channel.GetTitle(),
+				Username:   channel.GetUsername(),
 				AccessHash: channel.GetAccessHash(),
 			})
 		}
@@ -140,26 +162,40 @@ func (t *Telegram) getChannels() ([]TelegramChannel, error) {
 	return result, nil
 }
 
-func (t *Telegram) update() {
-	until := time.Now().Add(-time.Duration(t.LookingDuration) * time.Hour)
-	err := t.updateMemes(until)
+//update fetches memes with settings of config snapshot cfg
+func (t *Telegram) update(ctx context.Context, cfg *TomlConfig) {
+	until := time.Now().Add(-time.Duration(cfg.Telegram.LookingDuration) * time.Hour)
+	err := t.updateMemes(ctx, until, cfg)
 	if err != nil {
-		Log.Errorf("Cannot update memes. Reason %s", err)
+		t.log.Errorf("Cannot update memes. Reason %s", err)
 	}
 }
 
-func (t *Telegram) updateMemes(from time.Time) error {
+func (t *Telegram) updateMemes(ctx context.Context, from time.Time, cfg *TomlConfig) error {
 	channels, err := t.getChannels()
 	if err != nil {
 		return fmt.Errorf("Cannot get channels. Reason %s", err)
 	}
 	for _, ch := range channels {
-		memes, err := t.updateMemesFromChannel(from, ch)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !cfg.Telegram.isConfigured(ch) {
+			continue
+		}
+		disabled, err := t.storage.IsPublicDisabled("telegram", ch.ChanName)
+		if err != nil {
+			return err
+		}
+		if disabled {
+			continue
+		}
+		memes, err := t.updateMemesFromChannel(from, ch, cfg.Telegram.LoadStep)
 		if err != nil {
 			return fmt.Errorf("Cannot get memes from channel. Reason %s", err)
 		}
 		for _, meme := range memes {
-			err := storage.AddMeme(meme)
+			err := t.storage.AddMeme(ctx, meme, cfg.Collision.Distance)
 			if err != nil {
 				return fmt.Errorf("Cannot add meme %v to storage. Reason %s", meme, err)
 			}
@@ -168,16 +204,16 @@ func (t *Telegram) updateMemes(from time.Time) error {
 	return nil
 }
 
-func (t *Telegram) updateMemesFromChannel(from time.Time, channel TelegramChannel) ([]Meme, error) {
+func (t *Telegram) updateMemesFromChannel(from time.Time, channel TelegramChannel, loadStep int32) ([]Meme, error) {
 	memes := []Meme{}
 
 	skipCount := int32(0)
 	for {
-		msgs, err := t.getMessagesFromChannel(skipCount, t.LoadStep, channel)
+		msgs, err := t.getMessagesFromChannel(skipCount, loadStep, channel)
 		if err != nil {
-			return memes, fmt.Errorf("Cannot get messages from channel %d. Reason %s", channel, err)
+			return memes, fmt.Errorf("Cannot get messages from channel %s. Reason %s", channel.ChanName, err)
 		}
-		skipCount += t.LoadStep
+		skipCount += loadStep
 
 		for _, msgI := range msgs {
 			//if message is not a message from a channel then skip it
@@ -209,6 +245,7 @@ func (t *Telegram) updateMemesFromChannel(from time.Time, channel TelegramChanne
 				Comments:    0,
 				Time:        time.Unix(int64(msg.GetDate()), 0),
 				Pictures:    []string{fmt.Sprintf("%d", photoMsg.GetPhoto().GetPhoto().GetId())},
+				Link:        channel.messageLink(msg.GetId()),
 			})
 		}
 	}
@@ -217,7 +254,7 @@ func (t *Telegram) updateMemesFromChannel(from time.Time, channel TelegramChanne
 }
 
 func (t *Telegram) requestAuth(manager *mtproto.Manager) (*mtproto.Conn, error) {
-	Log.Infof("Trying to auth...")
+	t.log.Infof("Trying to auth...")
 	conn, sentCode, err := manager.NewAuthentication(t.PhoneNumber, t.AppID, t.AppHash, t.IP, t.Port)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot create new authentication. Reason %s", err)
@@ -225,13 +262,13 @@ func (t *Telegram) requestAuth(manager *mtproto.Manager) (*mtproto.Conn, error)
 
 	//Setup small http server to recieve code
 	tgauthcode := make(chan string, 1)
-	server := &http.Server{Addr: Config.ServeAddress}
+	server := &http.Server{Addr: t.serveAddress}
 	router := chi.NewRouter()
 	router.Get("/telegram/authcode/{code}", func(w http.ResponseWriter, req *http.Request) {
 		code := chi.URLParam(req, "code")
-		Log.Info("Sending code")
+		t.log.Info("Sending code")
 		tgauthcode <- code
-		Log.Infof("Shutting down server")
+		t.log.Infof("Shutting down server")
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 		defer cancel()
 		server.Shutdown(ctx)
@@ -245,7 +282,7 @@ func (t *Telegram) requestAuth(manager *mtproto.Manager) (*mtproto.Conn, error)
 
 	// sign-in with the code from the user input
 	smsCode := <-tgauthcode
-	Log.Info("Got code")
+	t.log.Info("Got code")
 	_, err = conn.SignIn(t.PhoneNumber, smsCode, sentCode.GetValue().PhoneCodeHash)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot sign into telegram. Reason %s", err)
@@ -278,3 +315,11 @@ func (t *Telegram) Init() error {
 
 	return nil
 }
+
+//messageLink is t.me link to message, private channels are linked by id
+func (c *TelegramChannel) messageLink(msgId int32) string {
+	if c.Username != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", c.Username, msgId)
+	}
+	return fmt.Sprintf("https://t.me/c/%d/%d", c.ChanId, msgId)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/toby3d/telegram"
+)
+
+const adminHelp = `/post - post top meme now
+/top [n] - show top n candidates
+/skip <id> - don't post meme to channel
+/ban <id> - never show meme anywhere
+/sources - list publics
+/disable <platform/public> - stop fetching and posting from public
+/enable <platform/public> - undo /disable
+/rescore - recalculate ratings and activity
+/stats - short statistics
+/queue - show publish queue
+/enqueue <id> [time] - add meme to queue, time is HH:MM or RFC3339
+/pin <item> [time] - pin queue item to time, without time unpin
+/move <item> <position> - move queue item
+/cancel <item> - cancel queue item`
+
+//isAdminChat checks that message is sent by admin to debug chat or directly to bot
+func (b *TelegramBot) isAdminChat(msg *telegram.Message) bool {
+	if msg.From == nil {
+		return false
+	}
+	if msg.Chat.ID != b.ChatIdDebug && !msg.Chat.IsPrivate() {
+		return false
+	}
+	for _, id := range b.Admins {
+		if id == msg.From.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *App) handleAdminCommand(msg *telegram.Message) {
+	var (
+		reply string
+		err   error
+	)
+	arg := strings.TrimSpace(msg.CommandArgument())
+
+	switch strings.ToLower(msg.Command()) {
+	case "post":
+		reply, err = a.adminPost()
+	case "top":
+		reply, err = a.adminTop(arg)
+	case "skip":
+		reply, err = a.adminSkip(arg)
+	case "ban":
+		reply, err = a.adminBan(arg)
+	case "sources":
+		reply, err = a.adminSources()
+	case "disable":
+		reply, err = a.adminDisable(arg, true)
+	case "enable":
+		reply, err = a.adminDisable(arg, false)
+	case "rescore":
+		reply, err = a.adminRescore()
+	case "stats":
+		reply, err = a.adminStats()
+	case "queue":
+		reply, err = a.adminQueue()
+	case "enqueue":
+		reply, err = a.adminEnqueue(arg)
+	case "pin":
+		reply, err = a.adminPin(arg)
+	case "move":
+		reply, err = a.adminMove(arg)
+	case "cancel":
+		reply, err = a.adminCancel(arg)
+	case "help":
+		reply = adminHelp
+	default:
+		return
+	}
+	if err != nil {
+		a.Log.Errorf("Cannot process command %s. Reason %s", msg.Command(), err)
+		reply = fmt.Sprintf("Ошибка: %s", err)
+	}
+
+	err = a.Bot.SendTextTo(msg.Chat.ID, reply)
+	if err != nil {
+		a.Log.Errorf("Cannot send reply for command %s. Reason %s", msg.Command(), err)
+	}
+}
+
+func (a *App) parseMemeId(arg string) (int, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, fmt.Errorf("Wrong meme id %q", arg)
+	}
+	_, err = a.Storage.GetMemeById(id)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot find meme %d. Reason %s", id, err)
+	}
+	return id, nil
+}
+
+func (a *App) adminPost() (string, error) {
+	meme, err := a.postTopMeme()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Запостил мем %d от %s", meme.Id, a.publicName(meme)), nil
+}
+
+func (a *App) adminTop(arg string) (string, error) {
+	n := 10
+	if arg != "" {
+		var err error
+		n, err = strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return "", fmt.Errorf("Wrong number %q", arg)
+		}
+	}
+
+	memes, err := a.selectTopMemes(a.Config().TelegramBot.ChatId, a.getScorer(a.Config().TelegramBot.ChatId), n)
+	if err != nil {
+		return "", err
+	}
+	if len(memes) == 0 {
+		return "Мемов нет", nil
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	for i, meme := range memes {
+		fmt.Fprintf(buf, "%d. #%d %s/%s %.2f\n", i+1, meme.Id, meme.Platform, meme.Public, meme.Score)
+	}
+	return buf.String(), nil
+}
+
+func (a *App) adminSkip(arg string) (string, error) {
+	id, err := a.parseMemeId(arg)
+	if err != nil {
+		return "", err
+	}
+	err = a.Storage.SkipMeme(a.Config().TelegramBot.ChatId, id)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Мем %d пропущен", id), nil
+}
+
+func (a *App) adminBan(arg string) (string, error) {
+	id, err := a.parseMemeId(arg)
+	if err != nil {
+		return "", err
+	}
+	err = a.Storage.BanMeme(id)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Мем %d забанен", id), nil
+}
+
+//configuredPublics returns publics from config as platform/public
+func (a *App) configuredPublics() []string {
+	cfg := a.Config()
+	res := []string{}
+	for public := range cfg.VK.Publics {
+		res = append(res, fmt.Sprintf("vk/%s", public))
+	}
+	for _, public := range cfg.Reddit.Publics {
+		res = append(res, fmt.Sprintf("reddit/%s", public))
+	}
+	for _, public := range cfg.Telegram.Publics {
+		res = append(res, fmt.Sprintf("telegram/%s", public))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (a *App) adminSources() (string, error) {
+	buf := bytes.NewBuffer([]byte{})
+	for _, public := range a.configuredPublics() {
+		parts := strings.SplitN(public, "/", 2)
+		disabled, err := a.Storage.IsPublicDisabled(parts[0], parts[1])
+		if err != nil {
+			return "", err
+		}
+		state := "on"
+		if disabled {
+			state = "off"
+		}
+		fmt.Fprintf(buf, "%s %s\n", public, state)
+	}
+	return buf.String(), nil
+}
+
+func (a *App) adminDisable(arg string, disabled bool) (string, error) {
+	parts := strings.SplitN(arg, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("Public should be in format platform/public, got %q", arg)
+	}
+	err := a.Storage.SetPublicDisabled(strings.ToLower(parts[0]), parts[1], disabled)
+	if err != nil {
+		return "", err
+	}
+	if disabled {
+		return fmt.Sprintf("%s выключен", arg), nil
+	}
+	return fmt.Sprintf("%s включен", arg), nil
+}
+
+func (a *App) adminRescore() (string, error) {
+	err := a.calculateCoeffs()
+	if err != nil {
+		return "", fmt.Errorf("Cannot calculate coeffs. Reason %s", err)
+	}
+	err = a.dump()
+	if err != nil {
+		return "", fmt.Errorf("Cannot dump memes. Reason %s", err)
+	}
+	return "Коэффициенты пересчитаны", nil
+}
+
+func (a *App) adminStats() (string, error) {
+	summary, err := a.Storage.GetSummary(a.Config().TelegramBot.ChatId)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Мемов: %d (за сутки %d)\nЗапощено: %d\n👍 %d 👎 %d\nЗабанено мемов: %d\nВыключено пабликов: %d",
+		summary.Memes, summary.MemesLast24, summary.Posted, summary.Likes, summary.Dislikes, summary.Banned, summary.Disabled), nil
+}
+
+func (a *App) adminQueue() (string, error) {
+	items, err := a.Storage.GetQueue(a.Config().TelegramBot.ChatId)
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "Очередь пуста", nil
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	for _, item := range items {
+		when := "следующий слот"
+		if !item.Scheduled.IsZero() {
+			when = item.Scheduled.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(buf, "%d. [%d] мем #%d, %s", item.Position, item.Id, item.MemeId, when)
+		if item.Attempts > 0 {
+			fmt.Fprintf(buf, ", попыток %d: %s", item.Attempts, item.Error)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String(), nil
+}
+
+//splitArgs splits command argument to id and optional rest
+func splitArgs(arg string) (int, string, error) {
+	parts := strings.SplitN(arg, " ", 2)
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("Wrong id %q", parts[0])
+	}
+	if len(parts) == 1 {
+		return id, "", nil
+	}
+	return id, strings.TrimSpace(parts[1]), nil
+}
+
+func (a *App) adminEnqueue(arg string) (string, error) {
+	parts := strings.SplitN(arg, " ", 2)
+	memeId, err := a.parseMemeId(parts[0])
+	if err != nil {
+		return "", err
+	}
+	at := ""
+	if len(parts) == 2 {
+		at = strings.TrimSpace(parts[1])
+	}
+	scheduled := time.Time{}
+	if at != "" {
+		scheduled, err = parseSlotTime(at)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	id, err := a.Storage.Enqueue(a.Config().TelegramBot.ChatId, memeId, scheduled)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Мем %d добавлен в очередь [%d]", memeId, id), nil
+}
+
+func (a *App) adminPin(arg string) (string, error) {
+	id, at, err := splitArgs(arg)
+	if err != nil {
+		return "", err
+	}
+	scheduled := time.Time{}
+	if at != "" {
+		scheduled, err = parseSlotTime(at)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = a.Storage.PinQueueItem(id, scheduled)
+	if err == NotFound {
+		return fmt.Sprintf("[%d] не найден в очереди", id), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if scheduled.IsZero() {
+		return fmt.Sprintf("[%d] откреплен", id), nil
+	}
+	return fmt.Sprintf("[%d] будет запощен %s", id, scheduled.Format("2006-01-02 15:04")), nil
+}
+
+func (a *App) adminMove(arg string) (string, error) {
+	id, positionStr, err := splitArgs(arg)
+	if err != nil {
+		return "", err
+	}
+	position, err := strconv.Atoi(positionStr)
+	if err != nil {
+		return "", fmt.Errorf("Wrong position %q", positionStr)
+	}
+
+	err = a.Storage.MoveQueueItem(a.Config().TelegramBot.ChatId, id, position)
+	if err == NotFound {
+		return fmt.Sprintf("[%d] не найден в очереди", id), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return a.adminQueue()
+}
+
+func (a *App) adminCancel(arg string) (string, error) {
+	id, _, err := splitArgs(arg)
+	if err != nil {
+		return "", err
+	}
+
+	err = a.Storage.CancelQueueItem(id)
+	if err == NotFound {
+		return fmt.Sprintf("[%d] не найден в очереди", id), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("[%d] отменен", id), nil
+}
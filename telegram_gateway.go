@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.com/toby3d/telegram"
+)
+
+//Limits of Bot API: 30 messages per second overall, 1 per second in private chat, 20 per minute in group
+const (
+	globalSendInterval  = time.Second / 30
+	privateSendInterval = time.Second
+	groupSendInterval   = 3 * time.Second
+
+	//keyboardEditInterval is minimal time between edits of keyboard of one message
+	keyboardEditInterval = 3 * time.Second
+
+	maxSendAttempts = 3
+)
+
+//library loses retry_after parameter, so it is parsed from description
+var retryAfterRegexp = regexp.MustCompile(`retry after (\d+)`)
+
+//sendGateway spaces requests to Bot API so flood limits are not hit
+type sendGateway struct {
+	sync.Mutex
+	nextGlobal time.Time
+	nextChat   map[int64]time.Time
+
+	pendingEdits map[string]*telegram.EditMessageReplyMarkupParameters
+	lastEdits    map[string]time.Time
+}
+
+func newSendGateway() *sendGateway {
+	return &sendGateway{
+		nextChat:     map[int64]time.Time{},
+		pendingEdits: map[string]*telegram.EditMessageReplyMarkupParameters{},
+		lastEdits:    map[string]time.Time{},
+	}
+}
+
+func chatSendInterval(chatId int64) time.Duration {
+	if chatId > 0 {
+		return privateSendInterval
+	}
+	return groupSendInterval
+}
+
+//reserveChat returns how long caller has to wait before request to chat and books slot for it
+func (g *sendGateway) reserveChat(chatId int64) time.Duration {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	at := now
+	if next := g.nextChat[chatId]; next.After(at) {
+		at = next
+	}
+	g.nextChat[chatId] = at.Add(chatSendInterval(chatId))
+
+	//chats which have not sent for long time are forgotten
+	for id, next := range g.nextChat {
+		if next.Before(now) {
+			delete(g.nextChat, id)
+		}
+	}
+	return at.Sub(now)
+}
+
+//reserveGlobal is called when chat slot comes, so waiting chats do not hold others
+func (g *sendGateway) reserveGlobal() time.Duration {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	at := now
+	if g.nextGlobal.After(at) {
+		at = g.nextGlobal
+	}
+	g.nextGlobal = at.Add(globalSendInterval)
+	return at.Sub(now)
+}
+
+//pause delays all requests to chat after 429 answer
+func (g *sendGateway) pause(chatId int64, d time.Duration) {
+	g.Lock()
+	defer g.Unlock()
+	until := time.Now().Add(d)
+	if g.nextChat[chatId].Before(until) {
+		g.nextChat[chatId] = until
+	}
+}
+
+func retryAfter(err error) (time.Duration, bool) {
+	match := retryAfterRegexp.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0, false
+	}
+	seconds, _ := strconv.Atoi(match[1])
+	return time.Duration(seconds) * time.Second, true
+}
+
+//send calls Bot API method for chat respecting limits. Request is repeated after retry_after if it is asked.
+func (b *TelegramBot) send(chatId int64, call func() error) error {
+	var err error
+	for attempt := 1; attempt <= maxSendAttempts; attempt++ {
+		time.Sleep(b.gateway.reserveChat(chatId))
+		time.Sleep(b.gateway.reserveGlobal())
+		err = call()
+		if err == nil {
+			return nil
+		}
+		wait, ok := retryAfter(err)
+		if !ok {
+			return err
+		}
+		b.log.Infof("Flood limit in chat %d, retry after %s", chatId, wait)
+		b.gateway.pause(chatId, wait)
+	}
+	return fmt.Errorf("Flood limit is not passed after %d attempts. Reason %s", maxSendAttempts, err)
+}
+
+//editKeyboard edits keyboard of message. Edits of one message are coalesced,
+//only latest keyboard is sent once per keyboardEditInterval.
+func (b *TelegramBot) editKeyboard(params *telegram.EditMessageReplyMarkupParameters) {
+	key := fmt.Sprintf("%d:%d", params.ChatID, params.MessageID)
+
+	b.gateway.Lock()
+	defer b.gateway.Unlock()
+
+	_, scheduled := b.gateway.pendingEdits[key]
+	b.gateway.pendingEdits[key] = params
+	if scheduled {
+		return
+	}
+
+	delay := time.Until(b.gateway.lastEdits[key].Add(keyboardEditInterval))
+	time.AfterFunc(delay, func() {
+		//pending edit is taken first, so key is not left scheduled when shutdown forbids sending
+		b.gateway.Lock()
+		params := b.gateway.pendingEdits[key]
+		delete(b.gateway.pendingEdits, key)
+		if !b.tasks.start() {
+			b.gateway.Unlock()
+			return
+		}
+		defer b.tasks.done()
+		now := time.Now()
+		b.gateway.lastEdits[key] = now
+		for k, last := range b.gateway.lastEdits {
+			if now.Sub(last) > keyboardEditInterval {
+				delete(b.gateway.lastEdits, k)
+			}
+		}
+		b.gateway.Unlock()
+
+		err := b.send(params.ChatID, func() error {
+			_, err := b.bot.EditMessageReplyMarkup(params)
+			return err
+		})
+		if err != nil {
+			b.log.Errorf("Cannot edit message for updating keyboard message. Reason %s", err)
+		}
+	})
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	log "github.com/sirupsen/logrus"
 	"gitlab.com/toby3d/telegram"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -13,13 +16,32 @@ import (
 
 const MEDIA_CAPTION_SIZE = 200
 
+//BotAPI is part of Bot API client used by bot, it is implemented by *telegram.Bot
+type BotAPI interface {
+	GetUpdates(params *telegram.GetUpdatesParameters) ([]telegram.Update, error)
+	SendMessage(params *telegram.SendMessageParameters) (*telegram.Message, error)
+	SendMediaGroup(params *telegram.SendMediaGroupParameters) ([]telegram.Message, error)
+	Upload(method, key, name string, file telegram.InputFile, args fmt.Stringer) (*telegram.Response, error)
+	EditMessageReplyMarkup(params *telegram.EditMessageReplyMarkupParameters) (*telegram.Message, error)
+	AnswerCallbackQuery(params *telegram.AnswerCallbackQueryParameters) (bool, error)
+	AnswerInlineQuery(params *telegram.AnswerInlineQueryParameters) (bool, error)
+	GetFile(fileID string) (*telegram.File, error)
+	NewFileURL(filePath string) *url.URL
+}
+
 type TelegramBot struct {
 	Token       string
-	bot         *telegram.Bot
+	bot         BotAPI
 	ChatId      int64
 	ChatIdDebug int64
+	Admins      []int
+	Workers     int
 	updateId    int
 	ch          chan telegram.Update
+	log         *log.Logger
+	gateway     *sendGateway
+	//tasks is tracker of App, delayed edits and workers are registered in it
+	tasks *taskTracker
 }
 
 type InlineButtonData struct {
@@ -47,71 +69,6 @@ func (b *InlineButtonData) Unpack(data string) error {
 	return nil
 }
 
-func HumanTime(t time.Time) string {
-	timeNow := time.Now()
-	if timeNow.Sub(t) < (time.Duration(5) * time.Minute) {
-		return "только что"
-	}
-	if timeNow.Sub(t) < (time.Duration(7) * time.Hour) {
-		hours := timeNow.Sub(t) / time.Hour
-		if hours == 0 {
-			return "меньше часа назад"
-		} else if hours == 1 {
-			return "час назад"
-		} else if hours >= 2 && hours <= 4 {
-			return fmt.Sprintf("%d часа назад", hours)
-		} else {
-			return fmt.Sprintf("%d часов назад", hours)
-		}
-	}
-	if t.Day() == timeNow.Day() {
-		hours := t.Hour()
-		if hours == 0 {
-			return "сегодня в полночь"
-		} else if hours == 1 {
-			return "в час ночи"
-		} else if hours >= 2 && hours <= 4 {
-			return fmt.Sprintf("в %d часа ночи", hours)
-		} else if hours == 5 {
-			return fmt.Sprintf("в %d часов ночи", hours)
-		} else if hours > 5 && hours <= 10 {
-			return fmt.Sprintf("в %d часов утра", hours)
-		} else if hours > 10 && hours <= 12 {
-			return fmt.Sprintf("в %d часов", hours)
-		} else if hours > 12 && hours <= 20 {
-			return fmt.Sprintf("в %d часов", hours-12)
-		} else if hours > 20 && hours <= 23 {
-			return fmt.Sprintf("в %d часов вечера", hours-12)
-		} else {
-			return fmt.Sprintf("в %d часов", hours)
-		}
-	}
-	temp := t.AddDate(0, 0, 1)
-	if timeNow.Year() == temp.Year() && timeNow.Month() == temp.Month() && timeNow.Day() == temp.Day() {
-		hours := t.Hour()
-		if hours == 0 {
-			return "вчера в полночь"
-		} else if hours == 1 {
-			return "вчера в час ночи"
-		} else if hours >= 2 && hours <= 4 {
-			return fmt.Sprintf("вчера в %d часа ночи", hours)
-		} else if hours == 5 {
-			return fmt.Sprintf("вчера в %d часов ночи", hours)
-		} else if hours > 5 && hours <= 10 {
-			return fmt.Sprintf("вчера в %d часов утра", hours)
-		} else if hours > 10 && hours <= 12 {
-			return fmt.Sprintf("вчера в %d часов", hours)
-		} else if hours > 12 && hours <= 20 {
-			return fmt.Sprintf("вчера в %d часов", hours-12)
-		} else if hours > 20 && hours <= 23 {
-			return fmt.Sprintf("вчера в %d часов вечера", hours-12)
-		} else {
-			return fmt.Sprintf("вчера в %d часов", hours)
-		}
-	}
-	return t.Format(time.RFC3339)
-}
-
 func packMetadata(data []InlineButtonData, mainIndex int) string {
 	if len(data) == 0 {
 		return ""
@@ -160,87 +117,152 @@ func NewInlineKeyboardCounter(data []InlineButtonData) *telegram.InlineKeyboardM
 	return telegram.NewInlineKeyboardMarkup(keyboardRow)
 }
 
-func (b *TelegramBot) Connect() error {
-	var err error
-	b.bot, err = telegram.New(b.Token)
+//login creates Bot API client, it is enough for sending messages
+func (b *TelegramBot) login() error {
+	bot, err := telegram.New(b.Token)
 	if err != nil {
 		return fmt.Errorf("Cannot connect to tg. Reason %s", err)
 	}
+	b.bot = bot
+	return nil
+}
+
+//Connect creates client and starts handling of updates by handle
+func (b *TelegramBot) Connect(ctx context.Context, handle func(telegram.Update)) error {
+	err := b.login()
+	if err != nil {
+		return err
+	}
+
+	err = b.Init(ctx)
+	if err != nil {
+		return err
+	}
 
-	go b.EventHandler()
+	go b.EventHandler(ctx, handle)
 
-	return b.Init()
+	return nil
 }
 
-func (b *TelegramBot) EventHandler() {
-	for update := range b.ch {
-		if update.CallbackQuery != nil {
-			Log.Infof("CallbackQuery %v", update.CallbackQuery)
-			Log.Infof("CallbackQuery.MSG %v", update.CallbackQuery.Message)
+//handleUpdate processes one update, it is called by worker of update key
+func (a *App) handleUpdate(update telegram.Update) {
+	if update.CallbackQuery != nil {
+		a.Log.Infof("CallbackQuery %v", update.CallbackQuery)
+		a.Log.Infof("CallbackQuery.MSG %v", update.CallbackQuery.Message)
 
-			metadata, mainIndex, err := unpackMetadata(update.CallbackQuery.Data)
-			if err != nil {
-				Log.Errorf("Cannot process update. Reason %s", err)
-				continue
-			}
+		if strings.HasPrefix(update.CallbackQuery.Data, moderationPrefix) {
+			a.handleModerationCallback(update.CallbackQuery)
+			return
+		}
 
-			err = storage.MakeAction("telegram",
-				update.CallbackQuery.Message.Chat.ID,
-				update.CallbackQuery.Message.ID,
-				update.CallbackQuery.From.ID,
-				mainIndex)
-			if err != nil {
-				Log.Errorf("Cannot make action. Reason %s", err)
-				continue
+		err := a.handleVote(update.CallbackQuery)
+		text := ""
+		if err != nil {
+			a.Log.Errorf("Cannot process vote. Reason %s", err)
+			chatId := int64(0)
+			if update.CallbackQuery.Message != nil {
+				chatId = update.CallbackQuery.Message.Chat.ID
 			}
-
-			counters, err := storage.CalculateCounter("telegram", update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Message.ID)
+			text = tr(a.Config().I18n.chatLocale(chatId), "callback_error")
+		}
+		_, err = a.Bot.bot.AnswerCallbackQuery(&telegram.AnswerCallbackQueryParameters{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+		})
+		if err != nil {
+			a.Log.Errorf("Cannot answer callback query. Reason %s", err)
+		}
+	}
+	if update.InlineQuery != nil {
+		a.handleInlineQuery(update.InlineQuery)
+	}
+	if update.Message != nil {
+		a.Log.Infof("Got new message in chat: %v", update.Message)
+		if update.Message.Chat.IsPrivate() && a.Config().Submission.Enabled &&
+			(update.Message.IsPhoto() || update.Message.IsVideo()) {
+			a.handleSubmission(update.Message)
+		} else if update.Message.Chat.IsPrivate() && update.Message.IsCommandEqual("mymeme") {
+			err := a.sendPersonalMeme(update.Message)
 			if err != nil {
-				Log.Errorf("Cannot calculate counters for messages. Reason %s", err)
+				a.Log.Errorf("Cannot send personal meme. Reason %s", err)
+				err = a.Bot.SendTextTo(update.Message.Chat.ID, "Не получилось подобрать мем, попробуй позже")
+				if err != nil {
+					a.Log.Errorf("Cannot answer personal meme request. Reason %s", err)
+				}
 			}
+		} else if update.Message.IsCommand() && a.Bot.isAdminChat(update.Message) {
+			a.handleAdminCommand(update.Message)
+		}
+	}
+}
 
-			for i := 0; i < len(metadata); i++ {
-				metadata[i].Counter = counters[i]
-			}
+//handleVote saves press of like/dislike button and updates counters on keyboard
+func (a *App) handleVote(query *telegram.CallbackQuery) error {
+	if query.Message == nil {
+		return fmt.Errorf("Callback query %s has no message", query.ID)
+	}
 
-			keyboard := telegram.EditMessageReplyMarkupParameters{
-				ChatID:      update.CallbackQuery.Message.Chat.ID,
-				MessageID:   update.CallbackQuery.Message.ID,
-				ReplyMarkup: NewInlineKeyboardCounter(metadata),
-			}
-			_, err = b.bot.EditMessageReplyMarkup(&keyboard)
-			if err != nil {
-				Log.Errorf("Cannot edit message for updating keyboard message. Reason %s", err)
-			}
+	metadata, mainIndex, err := unpackMetadata(query.Data)
+	if err != nil {
+		return fmt.Errorf("Cannot unpack metadata. Reason %s", err)
+	}
 
-			b.bot.AnswerCallbackQuery(&telegram.AnswerCallbackQueryParameters{
-				CallbackQueryID: update.CallbackQuery.ID,
-			})
-		}
-		if update.Message != nil {
-			Log.Infof("Got new message in chat: %v", update.Message)
-		}
+	err = a.Storage.MakeAction("telegram", query.Message.Chat.ID, query.Message.ID, query.From.ID, mainIndex)
+	if err != nil {
+		return fmt.Errorf("Cannot make action. Reason %s", err)
+	}
+
+	counters, err := a.Storage.CalculateCounter("telegram", query.Message.Chat.ID, query.Message.ID)
+	if err != nil {
+		return fmt.Errorf("Cannot calculate counters for messages. Reason %s", err)
 	}
+
+	for i := 0; i < len(metadata); i++ {
+		metadata[i].Counter = counters[i]
+	}
+
+	a.Bot.editKeyboard(&telegram.EditMessageReplyMarkupParameters{
+		ChatID:      query.Message.Chat.ID,
+		MessageID:   query.Message.ID,
+		ReplyMarkup: NewInlineKeyboardCounter(metadata),
+	})
+	return nil
 }
 
 func (b *TelegramBot) SendTextMessage(text string) error {
-	msg := telegram.NewMessage(b.ChatId, text)
+	return b.SendTextTo(b.ChatId, text)
+}
 
-	_, err := b.bot.SendMessage(msg)
+func (b *TelegramBot) SendTextTo(chatId int64, text string) error {
+	msg := telegram.NewMessage(chatId, text)
 
-	return err
+	return b.send(chatId, func() error {
+		_, err := b.bot.SendMessage(msg)
+		return err
+	})
 }
 
 func (b *TelegramBot) SendDebugText(text string) error {
 	msg := telegram.NewMessage(b.ChatIdDebug, text)
 	msg.DisableWebPagePreview = true
 
-	_, err := b.bot.SendMessage(msg)
+	return b.send(b.ChatIdDebug, func() error {
+		_, err := b.bot.SendMessage(msg)
+		return err
+	})
+}
+
+//MemeCaption is rendered caption of meme. ParseMode is empty for plain text.
+type MemeCaption struct {
+	Text      string
+	ParseMode string
+}
 
-	return err
+func (b *TelegramBot) SendPhoto(paths []string, caption MemeCaption) (int, error) {
+	return b.SendPhotoTo(b.ChatId, paths, caption)
 }
 
-func (b *TelegramBot) SendPhoto(paths []string, text, description string) (int, error) {
+func likeKeyboard() *telegram.InlineKeyboardMarkup {
 	btns := []InlineButtonData{
 		InlineButtonData{
 			Text:    "👍",
@@ -251,32 +273,42 @@ func (b *TelegramBot) SendPhoto(paths []string, text, description string) (int,
 			Counter: 0,
 		},
 	}
+	return NewInlineKeyboardCounter(btns)
+}
+
+//SendPhotoTo sends meme with like/dislike keyboard. Caption is expected to fit in MEDIA_CAPTION_SIZE.
+func (b *TelegramBot) SendPhotoTo(chatId int64, paths []string, caption MemeCaption) (int, error) {
+	if len(paths) == 0 {
+		return 0, fmt.Errorf("Cannot send photo. Reason: no photo")
+	} else if len(paths) == 1 {
+		res, err := b.sendMedia(chatId, paths[0], caption, likeKeyboard())
+		if err != nil {
+			return 0, fmt.Errorf("Cannot send meme. Reason %s", err)
+		}
+		return res.ID, nil
+	}
+
+	err := b.sendAlbum(chatId, paths, "")
+	if err != nil {
+		return 0, err
+	}
+	return b.sendKeyboardMessage(chatId, caption, likeKeyboard())
+}
 
+//SendPhotoWithKeyboard sends meme and returns id of message with keyboard
+func (b *TelegramBot) SendPhotoWithKeyboard(chatId int64, paths []string, text, description string, keyboard *telegram.InlineKeyboardMarkup) (int, error) {
 	if len(paths) == 0 {
 		return 0, fmt.Errorf("Cannot send photo. Reason: no photo")
 	} else if len(paths) == 1 {
-		caption := fmt.Sprintf("%s\n\n%s", text, description)
-		if len(caption) >= MEDIA_CAPTION_SIZE {
-			msg := telegram.NewPhoto(b.ChatId, paths[0])
-			msg.DisableWebPagePreview = true
-			res, err := b.bot.SendPhoto(msg)
+		caption := MemeCaption{Text: fmt.Sprintf("%s\n\n%s", text, description)}
+		if len(caption.Text) >= MEDIA_CAPTION_SIZE {
+			_, err := b.sendMedia(chatId, paths[0], MemeCaption{}, nil)
 			if err != nil {
 				return 0, fmt.Errorf("Cannot send meme. Reason %s", err)
 			}
-			msgKeyboard := telegram.NewMessage(b.ChatId, caption)
-			msgKeyboard.DisableWebPagePreview = true
-			msgKeyboard.ReplyMarkup = NewInlineKeyboardCounter(btns)
-			res, err = b.bot.SendMessage(msgKeyboard)
-			if err != nil {
-				return 0, fmt.Errorf("Cannot send message with keyboard. Reason %s", err)
-			}
-			return res.ID, nil
+			return b.sendKeyboardMessage(chatId, caption, keyboard)
 		} else {
-			msg := telegram.NewPhoto(b.ChatId, paths[0])
-			msg.Caption = fmt.Sprintf("%s\n\n%s", text, description)
-			msg.DisableWebPagePreview = true
-			msg.ReplyMarkup = NewInlineKeyboardCounter(btns)
-			res, err := b.bot.SendPhoto(msg)
+			res, err := b.sendMedia(chatId, paths[0], caption, keyboard)
 			if err != nil {
 				return 0, fmt.Errorf("Cannot send meme. Reason %s", err)
 			}
@@ -285,61 +317,150 @@ func (b *TelegramBot) SendPhoto(paths []string, text, description string) (int,
 		}
 
 	} else {
-		media := []interface{}{}
-		for i, path := range paths {
-			ph := telegram.NewInputMediaPhoto(path)
+		err := b.sendAlbum(chatId, paths, text)
+		if err != nil {
+			return 0, err
+		}
+		return b.sendKeyboardMessage(chatId, MemeCaption{Text: description}, keyboard)
+	}
+}
+
+//albumMedia makes media group of pictures, text is caption of first one
+func albumMedia(paths []string, text string) []interface{} {
+	media := []interface{}{}
+	for i, path := range paths {
+		if isVideo(path) {
+			fileId, _ := videoFileId(path)
+			video := telegram.NewInputMediaVideo(fileId)
 			if i == 0 {
-				ph.Caption = text
+				video.Caption = text
 			}
-			media = append(media, interface{}(ph))
+			media = append(media, interface{}(video))
+			continue
+		}
+		ph := telegram.NewInputMediaPhoto(path)
+		if i == 0 {
+			ph.Caption = text
 		}
-		Log.Infof("Sending %d photos", len(media))
+		media = append(media, interface{}(ph))
+	}
+	return media
+}
 
+//sendAlbum sends media group, text is caption of first item
+func (b *TelegramBot) sendAlbum(chatId int64, paths []string, text string) error {
+	media := albumMedia(paths, text)
+	b.log.Infof("Sending %d photos", len(media))
+
+	err := b.send(chatId, func() error {
 		_, err := b.bot.SendMediaGroup(&telegram.SendMediaGroupParameters{
-			ChatID: b.ChatId,
+			ChatID: chatId,
 			Media:  media,
 		})
-		if err != nil {
-			return 0, fmt.Errorf("Cannot send media group. Reason %s", err)
-		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot send media group. Reason %s", err)
+	}
+	return nil
+}
 
-		msgKeyboard := telegram.NewMessage(b.ChatId, description)
-		msgKeyboard.DisableWebPagePreview = true
-		msgKeyboard.ReplyMarkup = NewInlineKeyboardCounter(btns)
-		res, err := b.bot.SendMessage(msgKeyboard)
+func (b *TelegramBot) sendKeyboardMessage(chatId int64, caption MemeCaption, keyboard *telegram.InlineKeyboardMarkup) (int, error) {
+	msgKeyboard := telegram.NewMessage(chatId, caption.Text)
+	msgKeyboard.ParseMode = caption.ParseMode
+	msgKeyboard.DisableWebPagePreview = true
+	msgKeyboard.ReplyMarkup = keyboard
+	var res *telegram.Message
+	err := b.send(chatId, func() error {
+		var err error
+		res, err = b.bot.SendMessage(msgKeyboard)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Cannot send message with keyboard. Reason %s", err)
+	}
+	return res.ID, nil
+}
+
+//uploadArgs are form fields of upload request
+type uploadArgs url.Values
+
+func (a uploadArgs) String() string {
+	return url.Values(a).Encode()
+}
+
+//sendMedia sends one photo or video. Library ignores parse mode of photo and has no method for video,
+//so both are sent by generic upload.
+func (b *TelegramBot) sendMedia(chatId int64, path string, caption MemeCaption, keyboard *telegram.InlineKeyboardMarkup) (*telegram.Message, error) {
+	args := url.Values{}
+	args.Set("chat_id", strconv.FormatInt(chatId, 10))
+	if caption.Text != "" {
+		args.Set("caption", caption.Text)
+	}
+	if caption.ParseMode != "" {
+		args.Set("parse_mode", caption.ParseMode)
+	}
+	if keyboard != nil {
+		markup, err := json.Marshal(keyboard)
 		if err != nil {
-			return 0, fmt.Errorf("Cannot send message with keyboard. Reason %s", err)
+			return nil, fmt.Errorf("Cannot marshal keyboard. Reason %s", err)
 		}
-		return res.ID, nil
+		args.Set("reply_markup", string(markup))
+	}
+
+	method, key, file := telegram.MethodSendPhoto, "photo", path
+	if isVideo(path) {
+		method, key = telegram.MethodSendVideo, "video"
+		file, _ = videoFileId(path)
+	}
+	var resp *telegram.Response
+	err := b.send(chatId, func() error {
+		var err error
+		resp, err = b.bot.Upload(method, key, "", file, uploadArgs(args))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var res telegram.Message
+	err = json.Unmarshal(*resp.Result, &res)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse sent message. Reason %s", err)
 	}
+	return &res, nil
 }
 
 func (b *TelegramBot) SendPhotoViaURL(address string) error {
 	return b.SendTextMessage(address)
 }
 
-func (b *TelegramBot) Init() error {
-	b.ch = make(chan telegram.Update)
+//Init starts polling of updates. Long poll cannot be interrupted, so polling stops after it returns.
+func (b *TelegramBot) Init(ctx context.Context) error {
+	b.ch = make(chan telegram.Update, updatesBuffer)
 	go func() {
-		for {
+		for ctx.Err() == nil {
 			updates, err := b.bot.GetUpdates(&telegram.GetUpdatesParameters{
 				Offset:  b.updateId,
 				Timeout: 60,
 			})
-			Log.Infof("updates %v", updates)
+			b.log.Infof("updates %v", updates)
 			updatesStr, _ := json.Marshal(updates)
 			if err != nil {
-				Log.Errorf("Cannot recieve update from telegram. Reason %s", err)
+				b.log.Errorf("Cannot recieve update from telegram. Reason %s", err)
 				time.Sleep(time.Duration(3) * time.Second)
 				continue
 			}
 			if len(updates) > 0 {
-				Log.Infof("updates %s %s", updatesStr, err)
+				b.log.Infof("updates %s %s", updatesStr, err)
 			}
 			for _, update := range updates {
 				if update.ID >= b.updateId {
 					b.updateId = update.ID + 1
-					b.ch <- update
+					select {
+					case b.ch <- update:
+					case <-ctx.Done():
+						return
+					}
 				}
 			}
 		}
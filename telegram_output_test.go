@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/toby3d/telegram"
+)
+
+//fakeBot records answers and keyboard edits instead of calling Bot API
+type fakeBot struct {
+	sync.Mutex
+	answers []telegram.AnswerCallbackQueryParameters
+	edits   []telegram.EditMessageReplyMarkupParameters
+}
+
+func (f *fakeBot) GetUpdates(params *telegram.GetUpdatesParameters) ([]telegram.Update, error) {
+	return nil, nil
+}
+
+func (f *fakeBot) SendMessage(params *telegram.SendMessageParameters) (*telegram.Message, error) {
+	return &telegram.Message{ID: 1}, nil
+}
+
+func (f *fakeBot) SendMediaGroup(params *telegram.SendMediaGroupParameters) ([]telegram.Message, error) {
+	return nil, nil
+}
+
+func (f *fakeBot) Upload(method, key, name string, file telegram.InputFile, args fmt.Stringer) (*telegram.Response, error) {
+	return nil, fmt.Errorf("Upload is not supported by fake bot")
+}
+
+func (f *fakeBot) EditMessageReplyMarkup(params *telegram.EditMessageReplyMarkupParameters) (*telegram.Message, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.edits = append(f.edits, *params)
+	return &telegram.Message{ID: params.MessageID}, nil
+}
+
+func (f *fakeBot) AnswerCallbackQuery(params *telegram.AnswerCallbackQueryParameters) (bool, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.answers = append(f.answers, *params)
+	return true, nil
+}
+
+func (f *fakeBot) AnswerInlineQuery(params *telegram.AnswerInlineQueryParameters) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeBot) GetFile(fileID string) (*telegram.File, error) {
+	return nil, fmt.Errorf("GetFile is not supported by fake bot")
+}
+
+func (f *fakeBot) NewFileURL(filePath string) *url.URL {
+	return &url.URL{Path: filePath}
+}
+
+func (f *fakeBot) answerCount() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.answers)
+}
+
+//lastKeyboard returns texts of buttons of last edit of message
+func (f *fakeBot) lastKeyboard(chatId int64, msgId int) []string {
+	f.Lock()
+	defer f.Unlock()
+	for i := len(f.edits) - 1; i >= 0; i-- {
+		edit := f.edits[i]
+		if edit.ChatID != chatId || edit.MessageID != msgId {
+			continue
+		}
+		texts := []string{}
+		for _, btn := range edit.ReplyMarkup.InlineKeyboard[0] {
+			texts = append(texts, btn.Text)
+		}
+		return texts
+	}
+	return nil
+}
+
+func newTestApp(t *testing.T) (*App, *fakeBot) {
+	cfg := &TomlConfig{}
+	cfg.TelegramBot.Workers = 4
+
+	logger := log.New()
+	logger.Level = log.WarnLevel
+	s, err := NewStorage(filepath.Join(t.TempDir(), "test.db"), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.DB.Close() })
+
+	fake := &fakeBot{}
+	a := &App{
+		Log:      logger,
+		Storage:  s,
+		Bot:      &cfg.TelegramBot,
+		reloaded: newReloadNotifier(),
+		tasks:    &taskTracker{},
+		albums:   newAlbumCollector(),
+	}
+	a.ctx, a.stop = context.WithCancel(context.Background())
+	t.Cleanup(a.stop)
+	a.Bot.bot, a.Bot.log = fake, logger
+	a.Bot.gateway, a.Bot.tasks = newSendGateway(), a.tasks
+	a.config.Store(cfg)
+	return a, fake
+}
+
+func voteUpdate(id string, chatId int64, msgId, userId, btn int) telegram.Update {
+	data := packMetadata([]InlineButtonData{{Text: "👍"}, {Text: "👎"}}, btn)
+	return telegram.Update{CallbackQuery: &telegram.CallbackQuery{
+		ID:      id,
+		From:    &telegram.User{ID: userId},
+		Message: &telegram.Message{ID: msgId, Chat: &telegram.Chat{ID: chatId}},
+		Data:    data,
+	}}
+}
+
+func TestHandleUpdateVoteToggle(t *testing.T) {
+	a, fake := newTestApp(t)
+	const chatId, msgId = 101, 1
+
+	steps := []struct {
+		user, btn     int
+		like, dislike int
+	}{
+		{1, 0, 1, 0},
+		{2, 0, 2, 0},
+		{1, 1, 1, 1},
+		{1, 1, 1, 0},
+		{2, 0, 0, 0},
+	}
+	for i, step := range steps {
+		a.handleUpdate(voteUpdate(fmt.Sprintf("q%d", i), chatId, msgId, step.user, step.btn))
+		counters, err := a.Storage.CalculateCounter("telegram", chatId, msgId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counters[0] != step.like || counters[1] != step.dislike {
+			t.Errorf("step %d: counters %v, want %d likes and %d dislikes", i, counters, step.like, step.dislike)
+		}
+	}
+
+	if len(fake.answers) != len(steps) {
+		t.Fatalf("%d callback queries are answered, want %d", len(fake.answers), len(steps))
+	}
+	for _, answer := range fake.answers {
+		if answer.Text != "" {
+			t.Errorf("vote %s is answered with error %q", answer.CallbackQueryID, answer.Text)
+		}
+	}
+}
+
+func TestHandleUpdateVoteError(t *testing.T) {
+	a, fake := newTestApp(t)
+
+	update := voteUpdate("broken", 102, 1, 1, 0)
+	update.CallbackQuery.Data = "garbage"
+	a.handleUpdate(update)
+
+	update = voteUpdate("no message", 102, 1, 1, 0)
+	update.CallbackQuery.Message = nil
+	a.handleUpdate(update)
+
+	if len(fake.answers) != 2 {
+		t.Fatalf("%d callback queries are answered, want 2", len(fake.answers))
+	}
+	want := tr(DefaultLocale, "callback_error")
+	for _, answer := range fake.answers {
+		if answer.Text != want {
+			t.Errorf("query %s is answered with %q, want %q", answer.CallbackQueryID, answer.Text, want)
+		}
+	}
+	counters, err := a.Storage.CalculateCounter("telegram", 102, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counters) != 0 {
+		t.Errorf("broken votes are saved: %v", counters)
+	}
+}
+
+//TestEventHandlerSameMessageOrder checks that presses on one message are handled in order they came,
+//every user changes like to dislike, so reordering leaves likes
+func TestEventHandlerSameMessageOrder(t *testing.T) {
+	a, fake := newTestApp(t)
+	const chatId, msgId, otherMsgId, users = 103, 1, 2, 20
+
+	a.Bot.ch = make(chan telegram.Update, updatesBuffer)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Bot.EventHandler(ctx, a.handleUpdate)
+
+	for user := 1; user <= users; user++ {
+		a.Bot.ch <- voteUpdate(fmt.Sprintf("like%d", user), chatId, msgId, user, 0)
+		a.Bot.ch <- voteUpdate(fmt.Sprintf("other%d", user), chatId, otherMsgId, user, 0)
+		a.Bot.ch <- voteUpdate(fmt.Sprintf("dislike%d", user), chatId, msgId, user, 1)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for fake.answerCount() < 3*users && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := fake.answerCount(); n != 3*users {
+		t.Fatalf("%d callback queries are answered, want %d", n, 3*users)
+	}
+
+	counters, err := a.Storage.CalculateCounter("telegram", chatId, msgId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters[0] != 0 || counters[1] != users {
+		t.Errorf("counters %v, want 0 likes and %d dislikes", counters, users)
+	}
+
+	//edits are coalesced, so only last keyboard is checked
+	want := fmt.Sprintf("👍 0,👎 %d", users)
+	got := ""
+	deadline = time.Now().Add(2*keyboardEditInterval + 2*time.Second)
+	for time.Now().Before(deadline) {
+		if kb := fake.lastKeyboard(chatId, msgId); len(kb) == 2 {
+			got = kb[0] + "," + kb[1]
+			if got == want {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got != want {
+		t.Errorf("last keyboard is %q, want %q", got, want)
+	}
+}
+
+//TestEditKeyboardAfterShutdown checks that edit dropped on shutdown doesn't stay scheduled forever
+func TestEditKeyboardAfterShutdown(t *testing.T) {
+	a, _ := newTestApp(t)
+	err := a.tasks.wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Bot.editKeyboard(&telegram.EditMessageReplyMarkupParameters{ChatID: 105, MessageID: 1})
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		a.Bot.gateway.Lock()
+		pending := len(a.Bot.gateway.pendingEdits)
+		a.Bot.gateway.Unlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("edit is left pending after shutdown")
+}
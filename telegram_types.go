@@ -290,7 +290,6 @@ func NewMessage(msgI mtproto.TL) (Message, error) {
 			EditDate:     msg.Edit_date,
 		}, nil
 	default:
-		Log.Errorf("Cannot parse msg %v", msg)
-		return Message{}, nil
+		return Message{}, fmt.Errorf("Cannot parse msg %v", msg)
 	}
 }
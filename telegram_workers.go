@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"strconv"
+
+	"gitlab.com/toby3d/telegram"
+)
+
+const (
+	updatesBuffer   = 100
+	workerQueueSize = 100
+)
+
+func (b *TelegramBot) workers() int {
+	if b.Workers <= 0 {
+		return 8
+	}
+	return b.Workers
+}
+
+//updateKey is key of worker for update. Updates with same key are handled in order they came:
+//presses on buttons of one message, messages of one chat, inline queries of one user.
+func updateKey(update telegram.Update) string {
+	switch {
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		msg := update.CallbackQuery.Message
+		return strconv.FormatInt(msg.Chat.ID, 10) + ":" + strconv.Itoa(msg.ID)
+	case update.CallbackQuery != nil:
+		return "callback:" + update.CallbackQuery.ID
+	case update.Message != nil:
+		return strconv.FormatInt(update.Message.Chat.ID, 10)
+	case update.InlineQuery != nil:
+		return "inline:" + strconv.Itoa(update.InlineQuery.From.ID)
+	}
+	return ""
+}
+
+//EventHandler distributes updates among workers, so slow update does not delay updates of other messages.
+//On shutdown workers finish updates they already got.
+func (b *TelegramBot) EventHandler(ctx context.Context, handle func(telegram.Update)) {
+	workers := make([]chan telegram.Update, 0, b.workers())
+	for i := 0; i < cap(workers); i++ {
+		if !b.tasks.start() {
+			break
+		}
+		ch := make(chan telegram.Update, workerQueueSize)
+		workers = append(workers, ch)
+		go func() {
+			defer b.tasks.done()
+			for update := range ch {
+				handle(update)
+			}
+		}()
+	}
+	defer func() {
+		for _, ch := range workers {
+			close(ch)
+		}
+	}()
+	if len(workers) == 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update := <-b.ch:
+			h := fnv.New32a()
+			h.Write([]byte(updateKey(update)))
+			workers[h.Sum32()%uint32(len(workers))] <- update
+		}
+	}
+}
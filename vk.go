@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"path"
+	"text/template"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type VK struct {
@@ -28,6 +32,8 @@ type VK struct {
 	}
 
 	nextTimeRequest time.Time
+	storage         *Storage
+	log             *log.Logger
 }
 
 type VKWallAttachmentPhoto struct {
@@ -74,42 +80,22 @@ type VKWallGet struct {
 	} `json:"response"`
 }
 
-func (vk *VK) update() {
-	until := time.Now().Add(-time.Duration(vk.LookingDuration) * time.Hour)
-	err := vk.updateMemes(until)
+//update fetches memes with settings of config snapshot cfg
+func (vk *VK) update(ctx context.Context, cfg *TomlConfig) {
+	until := time.Now().Add(-time.Duration(cfg.VK.LookingDuration) * time.Hour)
+	err := vk.updateMemes(ctx, until, cfg)
 	if err != nil {
-		Log.Errorf("Cannot update memes. Reason %s", err)
+		vk.log.Errorf("Cannot update memes. Reason %s", err)
 	}
 }
 
-func (vk *VK) Init() error {
-	ticker := time.NewTicker(time.Duration(vk.UpdateTimeout) * time.Minute)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				vk.update()
-				err := storage.Dump()
-				if err != nil {
-					Log.Errorf("Cannot dump memes. Reason %s", err)
-					continue
-				}
-				err = storage.calculateCoeffs(Config.TelegramBot.ChatId)
-				if err != nil {
-					Log.Errorf("Cannot calculate groups rating. Reason %s", err)
-					continue
-				}
-			}
-		}
-	}()
-	return nil
+//sendRequest makes GET request, next request waits requestTimeout milliseconds.
+//Request and waiting are cancelled when ctx is done.
+func (vk *VK) sendRequest(ctx context.Context, vkMethod string, params map[string]interface{}, requestTimeout int) (string, error) {
+	return vk.sendRequestEx(ctx, "GET", vkMethod, params, nil, requestTimeout)
 }
 
-func (vk *VK) sendRequest(vkMethod string, params map[string]interface{}) (string, error) {
-	return vk.sendRequestEx("GET", vkMethod, params, nil)
-}
-
-func (vk *VK) sendRequestEx(method, vkMethod string, params map[string]interface{}, body io.Reader) (string, error) {
+func (vk *VK) sendRequestEx(ctx context.Context, method, vkMethod string, params map[string]interface{}, body io.Reader, requestTimeout int) (string, error) {
 	u, err := url.Parse(vk.ServerAddress)
 	if err != nil {
 		return "", fmt.Errorf("Cannot parse vk.ServerAddress. Reason %s", err)
@@ -119,30 +105,39 @@ func (vk *VK) sendRequestEx(method, vkMethod string, params map[string]interface
 	for k, v := range params {
 		q.Add(k, fmt.Sprintf("%v", v))
 	}
-	q.Add("access_token", Config.VK.Token)
-	q.Add("v", Config.VK.VkApiVersion)
+	q.Add("v", vk.VkApiVersion)
+	u.RawQuery = q.Encode()
+	//url without token is used in log and errors, errors are sent to debug chat
+	logURL := u.String()
+	q.Add("access_token", vk.Token)
 	u.RawQuery = q.Encode()
 
 	req, err := http.NewRequest(method, u.String(), body)
 	if err != nil {
-		return "", fmt.Errorf("Cannot create request. Url %s. Reason %s", u.String(), err)
+		return "", fmt.Errorf("Cannot create request. Url %s. Reason %s", logURL, err)
 	}
-
-	dump, err := httputil.DumpRequest(req, true)
-	Log.Infof("dump %s %s", dump, err)
+	req = req.WithContext(ctx)
+	vk.log.Debugf("Request %s %s", method, logURL)
 
 	for time.Now().Before(vk.nextTimeRequest) {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		time.Sleep(10 * time.Millisecond)
 	}
 
 	cli := &http.Client{}
 	resp, err := cli.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("Cannot perform %s request. URL %s. Reason %s", req.Method, req.URL.String(), err)
+		//url.Error contains url with token
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("Cannot perform %s request. URL %s. Reason %s", req.Method, logURL, err)
 	}
 	defer resp.Body.Close()
 
-	vk.nextTimeRequest = time.Now().Add(time.Duration(Config.VK.RequestTimeout) * time.Millisecond)
+	vk.nextTimeRequest = time.Now().Add(time.Duration(requestTimeout) * time.Millisecond)
 
 	if resp.StatusCode != 200 {
 		return "", fmt.Errorf("Unsuccessful status code %d. Status %s", resp.StatusCode, resp.Status)
@@ -163,3 +158,33 @@ func (vk *VK) sendRequestEx(method, vkMethod string, params map[string]interface
 
 	return string(bodyBytes), nil
 }
+
+//postLink builds link to wall post with LinkFormat template
+func (vk *VK) postLink(public, postId string) (string, error) {
+	if vk.LinkFormat == "" {
+		return "", nil
+	}
+	tmpl, err := template.New("link").Parse(vk.LinkFormat)
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse VK link format. Reason %s", err)
+	}
+	info, ok := vk.Publics[public]
+	if !ok {
+		return "", nil
+	}
+	//key of public is its screen name, group is set only if it differs
+	group := info.Group
+	if group == "" {
+		group = public
+	}
+	buf := bytes.NewBuffer([]byte{})
+	err = tmpl.Execute(buf, map[string]interface{}{
+		"Group":   group,
+		"GroupId": info.GroupId,
+		"PostId":  postId,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Cannot build link to post %s of %s. Reason %s", postId, public, err)
+	}
+	return buf.String(), nil
+}
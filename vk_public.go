@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"regexp"
@@ -26,17 +27,28 @@ func (p *VKWallPost) getBestPicture() []string {
 	return res
 }
 
-func (vk *VK) updateMemes(from time.Time) error {
-	regex := regexp.MustCompile(Config.VK.SpamFilter)
-	Log.Infof("updating memes until %s from publics %v", from.Format(time.RFC3339), vk.Publics)
-	for public, _ := range vk.Publics {
+func (vk *VK) updateMemes(ctx context.Context, from time.Time, cfg *TomlConfig) error {
+	conf := &cfg.VK
+	regex := regexp.MustCompile(conf.SpamFilter)
+	vk.log.Infof("updating memes until %s from publics %v", from.Format(time.RFC3339), conf.Publics)
+	for public, _ := range conf.Publics {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		disabled, err := vk.storage.IsPublicDisabled("vk", public)
+		if err != nil {
+			return err
+		}
+		if disabled {
+			continue
+		}
 	WallGet:
 		for i := 0; ; i++ {
-			resp, err := vk.sendRequest("wall.get", map[string]interface{}{
+			resp, err := vk.sendRequest(ctx, "wall.get", map[string]interface{}{
 				"domain": public,
 				"count":  100,
 				"offset": i * 100,
-			})
+			}, conf.RequestTimeout)
 			if err != nil {
 				return fmt.Errorf("Cannot make request for group %s. Reason %s", public, err)
 			}
@@ -69,14 +81,19 @@ func (vk *VK) updateMemes(from time.Time) error {
 					Time:        time.Unix(post.Date, 0),
 				}
 
+				mem.Link, err = conf.postLink(public, mem.MemeId)
+				if err != nil {
+					vk.log.Errorf("%s", err)
+				}
+
 				if regex.MatchString(mem.Description) {
-					Log.Infof("This post %v looks like adv", mem)
+					vk.log.Infof("This post %v looks like adv", mem)
 					continue
 				}
 
-				err = storage.AddMeme(mem)
+				err = vk.storage.AddMeme(ctx, mem, cfg.Collision.Distance)
 				if err != nil {
-					Log.Errorf("Cannot add meme %v to storage. Reason %s", mem, err)
+					vk.log.Errorf("Cannot add meme %v to storage. Reason %s", mem, err)
 				}
 			}
 		}